@@ -0,0 +1,163 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/burningalchemist/sql_exporter/config"
+	"github.com/xo/dburl"
+)
+
+const (
+	// Default scope of Azure AD tokens, used by Azure Database for PostgreSQL and MySQL.
+	azureDefaultScope = "https://ossrdbms-aad.database.windows.net/.default"
+	// Refresh Azure AD tokens this long before they expire, so new connections never use an expired token.
+	azureTokenRefreshMargin = 5 * time.Minute
+)
+
+// PasswordProvider supplies the password to open new connections with, for credentials that are fetched at
+// connection time and may expire (e.g. access tokens).
+type PasswordProvider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// NewPasswordProvider returns the PasswordProvider configured in the target options, or nil if the credentials in the
+// data source name are to be used as is.
+func NewPasswordProvider(opts *config.TargetOptions) (PasswordProvider, error) {
+	switch {
+	case opts == nil:
+		return nil, nil
+	case opts.AzureAuth != nil && opts.Vault != nil:
+		return nil, fmt.Errorf("azure_auth and vault are mutually exclusive")
+	case opts.AzureAuth != nil:
+		return newAzureTokenProvider(opts.AzureAuth)
+	case opts.Vault != nil:
+		return newVaultProvider(opts.Vault)
+	default:
+		return nil, nil
+	}
+}
+
+// azureTokenProvider implements PasswordProvider with Azure AD access tokens.
+type azureTokenProvider struct {
+	credential azcore.TokenCredential
+	scope      string
+
+	mu    sync.Mutex
+	token azcore.AccessToken
+}
+
+// newAzureTokenProvider returns a PasswordProvider fetching Azure AD tokens with the configured credential.
+func newAzureTokenProvider(ac *config.AzureAuthConfig) (*azureTokenProvider, error) {
+	var (
+		credential azcore.TokenCredential
+		err        error
+	)
+	switch ac.Mode {
+	case config.AzureAuthModeManagedIdentity:
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if ac.ClientID != "" {
+			opts.ID = azidentity.ClientID(ac.ClientID)
+		}
+		credential, err = azidentity.NewManagedIdentityCredential(opts)
+	case "", config.AzureAuthModeDefault:
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+	default:
+		return nil, fmt.Errorf("unsupported azure_auth mode %q", ac.Mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Azure credential: %w", err)
+	}
+
+	scope := ac.Scope
+	if scope == "" {
+		scope = azureDefaultScope
+	}
+	return &azureTokenProvider{credential: credential, scope: scope}, nil
+}
+
+// Password implements PasswordProvider.
+func (p *azureTokenProvider) Password(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Until(p.token.ExpiresOn) > azureTokenRefreshMargin {
+		return p.token.Token, nil
+	}
+	token, err := p.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{p.scope}})
+	if err != nil {
+		return "", fmt.Errorf("unable to get Azure AD token: %w", err)
+	}
+	slog.Debug("Refreshed Azure AD token", "scope", p.scope, "expires_on", token.ExpiresOn)
+	p.token = token
+	return p.token.Token, nil
+}
+
+// passwordConnector implements driver.Connector, opening each new connection with the current password from a
+// PasswordProvider in place of the one in the data source name.
+type passwordConnector struct {
+	driver   driver.Driver
+	url      *dburl.URL
+	provider PasswordProvider
+}
+
+// openWithPasswordProvider opens a DB handle whose connections authenticate with passwords from the provider.
+func openWithPasswordProvider(driverName string, u *dburl.URL, pp PasswordProvider) (*sql.DB, error) {
+	// Opening a handle doesn't connect, it's only used to look up the registered driver.
+	db, err := sql.Open(driverName, u.DSN)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	return sql.OpenDB(&passwordConnector{driver: drv, url: u, provider: pp}), nil
+}
+
+// Connect implements driver.Connector.
+func (c *passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := c.provider.Password(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	withPassword := *c.url
+	username := ""
+	if c.url.User != nil {
+		username = c.url.User.Username()
+	}
+	withPassword.User = url.UserPassword(username, password)
+	// Regenerate the driver DSN, so the password ends up in whatever format the driver expects.
+	u, err := dburl.Parse(withPassword.String())
+	if err != nil {
+		// Same as safeParse, don't leak the URL (and the password in it) through the error.
+		if uerr := new(url.Error); errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("unable to build data source name: %w", err)
+	}
+
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(u.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return connector.Connect(ctx)
+	}
+	return c.driver.Open(u.DSN)
+}
+
+// Driver implements driver.Connector.
+func (c *passwordConnector) Driver() driver.Driver {
+	return c.driver
+}
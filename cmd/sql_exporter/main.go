@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -26,6 +30,10 @@ const (
 	appName string = "sql_exporter"
 
 	httpReadHeaderTimeout time.Duration = time.Duration(time.Second * 60)
+
+	// Default and maximum number of rows returned by the debug query handler.
+	debugDefaultRows = 10
+	debugMaxRows     = 1000
 )
 
 var (
@@ -33,6 +41,8 @@ var (
 	listenAddress = flag.String("web.listen-address", ":9399", "Address to listen on for web interface and telemetry")
 	metricsPath   = flag.String("web.metrics-path", "/metrics", "Path under which to expose metrics")
 	enableReload  = flag.Bool("web.enable-reload", false, "Enable reload collector data handler")
+	enableDebug   = flag.Bool("web.enable-debug-queries", false, "Enable the handler returning raw query results, exposing the underlying data")
+	shutdownGrace = flag.Duration("web.shutdown-grace-period", 10*time.Second, "How long to wait for in-flight scrapes to complete on shutdown, before canceling them")
 	webConfigFile = flag.String("web.config.file", "", "[EXPERIMENTAL] TLS/BasicAuth configuration file path")
 	configFile    = flag.String("config.file", "sql_exporter.yml", "SQL Exporter configuration file path")
 	configCheck   = flag.Bool("config.check", false, "Check configuration and exit")
@@ -47,6 +57,17 @@ func init() {
 	flag.BoolVar(&cfg.IgnoreMissingVals, "config.ignore-missing-values", false, "[EXPERIMENTAL] Ignore results with missing values for the requested columns")
 	flag.StringVar(&cfg.DsnOverride, "config.data-source-name", "", "Data source name to override the value in the configuration file with")
 	flag.StringVar(&cfg.TargetLabel, "config.target-label", "target", "Target label name")
+	flag.StringVar(&cfg.InstanceLabel, "config.instance-label", "", "Label name to expose the host parsed from the data source name with, disabled if empty")
+	flag.BoolVar(&cfg.PreparedStatementMetric, "config.prepared-statement-metric", false, "Export whether the last execution of each query used a prepared statement")
+	flag.BoolVar(&cfg.QuerySQLHashMetric, "config.query-sql-hash-metric", false, "Export a hash of the SQL text of each query, to detect configuration drift")
+	flag.BoolVar(&cfg.QueryColumnsMetric, "config.query-columns-metric", false, "Export the number of columns expected and returned by each query, to detect schema drift")
+	flag.BoolVar(&cfg.LastRowTimestampMetric, "config.last-row-timestamp-metric", false, "Export the last time each query returned rows")
+	flag.BoolVar(&cfg.ConnectionOpenMetric, "config.connection-open-metric", false, "Export how long it took each target to open its database handle and answer the first ping")
+	flag.BoolVar(&cfg.StatementCacheMetrics, "config.statement-cache-metrics", false, "Export the prepared statements cached per query, and the hits, misses and evictions of the cache")
+	flag.BoolVar(&cfg.ClampedValuesMetric, "config.clamped-values-metric", false, "Export the number of values limited by clamp transformations, per query and column")
+	flag.BoolVar(&cfg.QueryInfoMetric, "config.query-info-metric", false, "Export the duration, rows processed and filtered and success of the last run of each query")
+	flag.BoolVar(&cfg.DBVersionMetric, "config.db-version-metric", false, "Export the database server version of each target, queried with the built-in query for its driver unless overridden by version_query")
+	flag.IntVar(&cfg.MaxLabelLength, "config.max-label-length", 0, "Truncate key label values longer than this many characters, unlimited if 0")
 }
 
 func main() {
@@ -117,16 +138,54 @@ func main() {
 	if *enableReload {
 		http.HandleFunc("/reload", reloadHandler(exporter, *configFile))
 	}
+	// Expose raw query results for troubleshooting, only on demand since it bypasses the metric definitions
+	if *enableDebug {
+		http.HandleFunc("/debug/query", debugQueryHandler(exporter))
+	}
 
-	server := &http.Server{Addr: *listenAddress, ReadHeaderTimeout: httpReadHeaderTimeout}
+	// Scrapes in flight are canceled through the base context of their requests, once the grace period is over.
+	scrapeCtx, cancelScrapes := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:              *listenAddress,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return scrapeCtx },
+	}
+	drained := shutdownHandler(server, exporter, cancelScrapes, *shutdownGrace)
 	if err := web.ListenAndServe(server, &web.FlagConfig{
 		WebListenAddresses: &([]string{*listenAddress}),
 		WebConfigFile:      webConfigFile, WebSystemdSocket: OfBool(false),
-	}, logConfig.logger); err != nil {
+	}, logConfig.logger); err != http.ErrServerClosed {
 		slog.Error("Error starting web server", "error", err)
 		os.Exit(1)
 
 	}
+	<-drained
+}
+
+// shutdownHandler listens for SIGINT and SIGTERM signals and shuts the web server down, waiting up to the grace period
+// for in-flight scrapes to complete before canceling them and closing the database handles. The returned channel is
+// closed once done.
+func shutdownHandler(
+	server *http.Server, e sql_exporter.Exporter, cancelScrapes context.CancelFunc, grace time.Duration,
+) <-chan struct{} {
+	drained := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer close(drained)
+		<-c
+		slog.Info("Shutting down, draining in-flight scrapes", "grace_period", grace)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Grace period exceeded, canceling in-flight scrapes", "error", err)
+		}
+		cancelScrapes()
+		if err := e.Close(); err != nil {
+			slog.Error("Error closing database handles", "error", err)
+		}
+	}()
+	return drained
 }
 
 // reloadHandler returns a handler that reloads collector and target data.
@@ -141,6 +200,32 @@ func reloadHandler(e sql_exporter.Exporter, configFile string) http.HandlerFunc
 	}
 }
 
+// debugQueryHandler returns a handler running the `query` on the `target` (empty in single target mode), responding
+// with up to `rows` (10 by default) of its raw results as JSON.
+func debugQueryHandler(e sql_exporter.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		maxRows := debugDefaultRows
+		if v := params.Get("rows"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > debugMaxRows {
+				http.Error(w, fmt.Sprintf("rows must be between 1 and %d", debugMaxRows), http.StatusBadRequest)
+				return
+			}
+			maxRows = n
+		}
+
+		rows, err := sql_exporter.DebugQuery(r.Context(), e, params.Get("target"), params.Get("query"), maxRows)
+		if err != nil {
+			slog.Error("Error running debug query", "target", params.Get("target"), "query", params.Get("query"), "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rows)
+	}
+}
+
 // signalHandler listens for SIGHUP signals and reloads the collector and target data.
 func signalHandler(e sql_exporter.Exporter, configFile string) {
 	c := make(chan os.Signal, 1)
@@ -5,12 +5,14 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/burningalchemist/sql_exporter/config"
 	"github.com/burningalchemist/sql_exporter/errors"
 	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
 )
 
 // Collector is a self-contained group of SQL queries and metric families to collect from a specific database. It is
@@ -28,29 +30,51 @@ type collector struct {
 }
 
 // NewCollector returns a new Collector with the given configuration and database. The metrics it creates will all have
-// the provided const labels applied.
-func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair) (Collector, errors.WithContext) {
+// the provided const labels applied. Queries not allowed by the QueryFilter (if any) are left out. The database names
+// of the target connections (the main one being "") populate the database label of queries configuring one.
+func NewCollector(
+	logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair, qf *config.QueryFilter,
+	databases map[string]string,
+) (Collector, errors.WithContext) {
 	logContext = TrimMissingCtx(fmt.Sprintf(`%s,collector=%s`, logContext, cc.Name))
 
-	// Maps each query to the list of metric families it populates.
+	// Maps each query to the list of metric families it populates, queries being ordered by their first metric.
 	queryMFs := make(map[*config.QueryConfig][]*MetricFamily, len(cc.Metrics))
+	queryOrder := make([]*config.QueryConfig, 0, len(cc.Metrics))
 
 	// Instantiate metric families.
 	for _, mc := range cc.Metrics {
-		mf, err := NewMetricFamily(logContext, mc, constLabels)
+		labels := constLabels
+		if name := mc.Query().DatabaseLabel; name != "" {
+			if slices.Contains(mc.KeyLabels, name) {
+				return nil, errors.Errorf(logContext, "database_label %q is also a key label of metric %q", name, mc.Name)
+			}
+			labels = append(constLabels[:len(constLabels):len(constLabels)], &dto.LabelPair{
+				Name:  proto.String(name),
+				Value: proto.String(databases[mc.Query().Connection]),
+			})
+		}
+		mf, err := NewMetricFamily(logContext, mc, labels)
 		if err != nil {
 			return nil, err
 		}
 		mfs, found := queryMFs[mc.Query()]
 		if !found {
 			mfs = make([]*MetricFamily, 0, 2)
+			queryOrder = append(queryOrder, mc.Query())
 		}
 		queryMFs[mc.Query()] = append(mfs, mf)
 	}
 
 	// Instantiate queries.
 	queries := make([]*Query, 0, len(cc.Metrics))
-	for qc, mfs := range queryMFs {
+	for _, qc := range queryOrder {
+		mfs := queryMFs[qc]
+		// Disabled queries are never instantiated, so they neither prepare statements nor use connections.
+		if !qf.Allows(qc.Name) {
+			slog.Info("Query disabled by query_filter, skipping", "logContext", logContext, "query", qc.Name)
+			continue
+		}
 		q, err := NewQuery(logContext, qc, mfs...)
 		if err != nil {
 			return nil, err
@@ -72,6 +96,10 @@ func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*
 
 // Collect implements Collector.
 func (c *collector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	if c.config.OrderedMetrics {
+		c.collectOrdered(ctx, conn, ch)
+		return
+	}
 	var wg sync.WaitGroup
 	wg.Add(len(c.queries))
 	for _, q := range c.queries {
@@ -84,11 +112,44 @@ func (c *collector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric)
 	wg.Wait()
 }
 
+// collectOrdered runs the queries concurrently, same as Collect, but buffers their metrics to send them in a stable
+// order: query by query in the order of their first metric in the configuration, the metrics of each query in the
+// order it produced them.
+func (c *collector) collectOrdered(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	buffers := make([][]Metric, len(c.queries))
+	var wg sync.WaitGroup
+	wg.Add(len(c.queries))
+	for i, q := range c.queries {
+		go func(i int, q *Query) {
+			defer wg.Done()
+			queryCh := make(chan Metric, capMetricChan)
+			buffered := make(chan struct{})
+			go func() {
+				defer close(buffered)
+				for metric := range queryCh {
+					buffers[i] = append(buffers[i], metric)
+				}
+			}()
+			q.Collect(ctx, conn, queryCh)
+			close(queryCh)
+			<-buffered
+		}(i, q)
+	}
+	wg.Wait()
+
+	for _, metrics := range buffers {
+		for _, metric := range metrics {
+			ch <- metric
+		}
+	}
+}
+
 // newCachingCollector returns a new Collector wrapping the provided raw Collector.
 func newCachingCollector(rawColl *collector) Collector {
 	cc := &cachingCollector{
 		rawColl:     rawColl,
 		minInterval: time.Duration(rawColl.config.MinInterval),
+		staleAfter:  time.Duration(rawColl.config.StaleAfter),
 		cacheSem:    make(chan time.Time, 1),
 	}
 	cc.cacheSem <- time.Time{}
@@ -101,11 +162,17 @@ type cachingCollector struct {
 	rawColl *collector
 	// Convenience copy of rawColl.config.MinInterval.
 	minInterval time.Duration
+	// Convenience copy of rawColl.config.StaleAfter.
+	staleAfter time.Duration
 
 	// Used as a non=blocking semaphore protecting the cache. The value in the channel is the time of the cached metrics.
 	cacheSem chan time.Time
 	// Metrics saved from the last Collect() call.
 	cache []Metric
+	// Metrics from the last collection without errors and its time, served in place of failed collections until they
+	// are older than staleAfter. Only used when staleAfter is non-zero.
+	lastGood     []Metric
+	lastGoodTime time.Time
 }
 
 // Collect implements Collector.
@@ -128,16 +195,20 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 				cc.rawColl.Collect(ctx, conn, cacheChan)
 				close(cacheChan)
 			}()
-			for metric := range cacheChan {
-				// catch invalid metrics and return them immediately, don't cache them
-				if ctx.Err() != nil {
-					slog.Debug("Context closed, returning invalid metric", "logContext", cc.rawColl.logContext)
-					ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
-					continue
-				}
+			if cc.staleAfter > 0 {
+				cc.collectWithFallback(ctx, cacheChan, ch, collTime)
+			} else {
+				for metric := range cacheChan {
+					// catch invalid metrics and return them immediately, don't cache them
+					if ctx.Err() != nil {
+						slog.Debug("Context closed, returning invalid metric", "logContext", cc.rawColl.logContext)
+						ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
+						continue
+					}
 
-				cc.cache = append(cc.cache, metric)
-				ch <- metric
+					cc.cache = append(cc.cache, metric)
+					ch <- metric
+				}
 			}
 			cacheTime = collTime
 		} else {
@@ -154,3 +225,47 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 		ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
 	}
 }
+
+// collectWithFallback caches the freshly collected metrics and pipes them through, unless the collection failed: then
+// the last metrics collected without errors are served (along with the errors) instead, until they are older than
+// staleAfter. Past that they are dropped, so that an outage doesn't show as frozen data.
+func (cc *cachingCollector) collectWithFallback(ctx context.Context, fresh <-chan Metric, ch chan<- Metric, collTime time.Time) {
+	failed := false
+	for metric := range fresh {
+		if ctx.Err() != nil {
+			slog.Debug("Context closed, returning invalid metric", "logContext", cc.rawColl.logContext)
+			ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
+			failed = true
+			continue
+		}
+		if metric.Desc() == nil {
+			failed = true
+		}
+		cc.cache = append(cc.cache, metric)
+	}
+
+	if !failed {
+		cc.lastGood, cc.lastGoodTime = cc.cache, collTime
+	} else if cc.lastGood != nil {
+		if age := collTime.Sub(cc.lastGoodTime); age <= cc.staleAfter {
+			slog.Warn("Collection failed, serving last good metrics", "logContext", cc.rawColl.logContext,
+				"age", age.Seconds(), "stale_after", cc.staleAfter.Seconds())
+			errs := cc.cache
+			cc.cache = make([]Metric, 0, len(cc.lastGood)+len(errs))
+			cc.cache = append(cc.cache, cc.lastGood...)
+			for _, metric := range errs {
+				if metric.Desc() == nil {
+					cc.cache = append(cc.cache, metric)
+				}
+			}
+		} else {
+			slog.Warn("Collection failed and last good metrics are stale, dropping them", "logContext", cc.rawColl.logContext,
+				"age", age.Seconds(), "stale_after", cc.staleAfter.Seconds())
+			cc.lastGood = nil
+		}
+	}
+
+	for _, metric := range cc.cache {
+		ch <- metric
+	}
+}
@@ -0,0 +1,51 @@
+package sql_exporter
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	sqlerrors "github.com/burningalchemist/sql_exporter/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectWithFallback(t *testing.T) {
+	desc := NewAutomaticMetricDesc("", "test", "Test metric.", prometheus.GaugeValue, nil)
+	good := NewMetric(desc, 1)
+	failure := NewInvalidMetric(sqlerrors.New("", "query failed"))
+	cc := &cachingCollector{rawColl: &collector{}, staleAfter: time.Minute}
+	start := time.Now()
+
+	for _, tc := range []struct {
+		name  string
+		at    time.Duration
+		fresh []Metric
+		want  []Metric
+	}{
+		{"Success", 0, []Metric{good}, []Metric{good}},
+		{"FailureUnderStaleAfter", 30 * time.Second, []Metric{failure}, []Metric{good, failure}},
+		{"FailureAtStaleAfter", time.Minute, []Metric{failure}, []Metric{good, failure}},
+		{"FailurePastStaleAfter", 2 * time.Minute, []Metric{failure}, []Metric{failure}},
+		{"FailureAfterDrop", 2*time.Minute + time.Second, []Metric{failure}, []Metric{failure}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fresh := make(chan Metric, len(tc.fresh))
+			for _, m := range tc.fresh {
+				fresh <- m
+			}
+			close(fresh)
+			ch := make(chan Metric, 10)
+			cc.cache = nil
+			cc.collectWithFallback(context.Background(), fresh, ch, start.Add(tc.at))
+			close(ch)
+			var got []Metric
+			for m := range ch {
+				got = append(got, m)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("expected %v but got: %v", tc.want, got)
+			}
+		})
+	}
+}
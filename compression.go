@@ -0,0 +1,124 @@
+package sql_exporter
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trinodb/trino-go-client/trino"
+	"github.com/xo/dburl"
+)
+
+// compressionClients is used to generate unique names for the HTTP clients registered with the Trino driver.
+var compressionClients atomic.Uint64
+
+// enableCompression returns the data source name amended to request compressed responses from the server, for the
+// drivers that support it. Where the driver allows it (i.e. over HTTP), the bytes received over the wire are added to
+// transferred, so the effect of compression can be measured.
+func enableCompression(logContext, driverName string, u *dburl.URL, transferred prometheus.Counter) (*dburl.URL, error) {
+	query := u.Query()
+	switch driverName {
+	case "clickhouse":
+		if query.Has("compress") {
+			return u, nil
+		}
+		query.Set("compress", "true")
+	case "trino":
+		if query.Has("custom_client") {
+			slog.Warn("Compression not enabled, the DSN already sets a custom client", "logContext", logContext)
+			return u, nil
+		}
+		base := http.DefaultTransport.(*http.Transport).Clone()
+		client := &http.Client{Transport: &gzipTransport{base: base, transferred: transferred}}
+		name := fmt.Sprintf("sql_exporter_gzip_%d", compressionClients.Add(1))
+		if err := trino.RegisterCustomClient(name, client); err != nil {
+			return nil, err
+		}
+		query.Set("custom_client", name)
+	default:
+		slog.Warn("Compression is not supported by the driver, ignoring", "logContext", logContext, "driver", driverName)
+		return u, nil
+	}
+
+	// Regenerate the driver DSN from the amended URL, the parameters are passed through to the driver.
+	amended := u.URL
+	amended.RawQuery = query.Encode()
+	return reparse(amended)
+}
+
+// gzipTransport is an http.RoundTripper requesting gzip compressed responses and decompressing them itself (rather
+// than leaving it to http.Transport), so it can count the bytes actually received.
+type gzipTransport struct {
+	base        http.RoundTripper
+	transferred prometheus.Counter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.Body
+	if t.transferred != nil {
+		body = &countingReadCloser{ReadCloser: body, counter: t.transferred}
+	}
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		resp.Body = body
+		return resp, nil
+	}
+
+	resp.Body = &gzipReadCloser{body: body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// gzipReadCloser decompresses a response body, lazily so that reading errors are returned by Read.
+type gzipReadCloser struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+}
+
+// Read implements io.Reader.
+func (r *gzipReadCloser) Read(p []byte) (int, error) {
+	if r.zr == nil {
+		zr, err := gzip.NewReader(r.body)
+		if err != nil {
+			return 0, err
+		}
+		r.zr = zr
+	}
+	return r.zr.Read(p)
+}
+
+// Close implements io.Closer.
+func (r *gzipReadCloser) Close() error {
+	return r.body.Close()
+}
+
+// countingReadCloser adds the number of bytes read to a counter.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+// Read implements io.Reader.
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
@@ -12,10 +12,12 @@ import (
 
 // CollectorConfig defines a set of metrics and how they are collected.
 type CollectorConfig struct {
-	Name        string          `yaml:"collector_name"`         // name of this collector
-	MinInterval model.Duration  `yaml:"min_interval,omitempty"` // minimum interval between query executions
-	Metrics     []*MetricConfig `yaml:"metrics"`                // metrics/queries defined by this collector
-	Queries     []*QueryConfig  `yaml:"queries,omitempty"`      // named queries defined by this collector
+	Name           string          `yaml:"collector_name"`            // name of this collector
+	MinInterval    model.Duration  `yaml:"min_interval,omitempty"`    // minimum interval between query executions
+	StaleAfter     model.Duration  `yaml:"stale_after,omitempty"`     // with min_interval, serve the last good metrics on failures for this long
+	OrderedMetrics bool            `yaml:"ordered_metrics,omitempty"` // send the metrics of the concurrently run queries in the order of the configuration
+	Metrics        []*MetricConfig `yaml:"metrics"`                   // metrics/queries defined by this collector
+	Queries        []*QueryConfig  `yaml:"queries,omitempty"`         // named queries defined by this collector
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]any `yaml:",inline" json:"-"`
@@ -34,12 +36,28 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if len(c.Metrics) == 0 {
 		return fmt.Errorf("no metrics defined for collector %q", c.Name)
 	}
+	if c.StaleAfter < 0 {
+		return fmt.Errorf("stale_after must not be negative for collector %q", c.Name)
+	}
 
 	// Set metric.query for all metrics: resolve query references (if any) and generate QueryConfigs for literal queries.
 	queries := make(map[string]*QueryConfig, len(c.Queries))
 	for _, query := range c.Queries {
 		queries[query.Name] = query
 	}
+	for _, query := range c.Queries {
+		if query.ParamsFrom == nil {
+			continue
+		}
+		source, found := queries[query.ParamsFrom.QueryRef]
+		if !found {
+			return fmt.Errorf("unresolved params_from query_ref %q in query %q of collector %q", query.ParamsFrom.QueryRef, query.Name, c.Name)
+		}
+		if source.ParamsFrom != nil {
+			return fmt.Errorf("params_from query %q of query %q in collector %q cannot have params_from itself", source.Name, query.Name, c.Name)
+		}
+		query.ParamsFrom.query = source
+	}
 	for _, metric := range c.Metrics {
 		if metric.QueryRef != "" {
 			query, found := queries[metric.QueryRef]
@@ -54,9 +72,41 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(any) error) error {
 				Name:                metric.Name,
 				Query:               metric.QueryLiteral,
 				NoPreparedStatement: metric.NoPreparedStatement,
+				SampleRate:          metric.SampleRate,
+				Retries:             metric.Retries,
+				RetryOnEmpty:        metric.RetryOnEmpty,
+				LenientScan:         metric.LenientScan,
+				CaseInsensitive:     metric.CaseInsensitive,
+				StrictColumns:       metric.StrictColumns,
+				EmptyAsNull:         metric.EmptyAsNull,
+				LogLevel:            metric.LogLevel,
+				Connection:          metric.Connection,
+				DatabaseLabel:       metric.DatabaseLabel,
+				SlowLogThreshold:    metric.SlowLogThreshold,
+				TimeParams:          metric.TimeParams,
+				TimeParamsLayout:    metric.TimeParamsLayout,
+				MaxLabelLength:      metric.MaxLabelLength,
+				IgnoreMissingVals:   metric.IgnoreMissingVals,
+				MissingValueDefault: metric.MissingValueDefault,
+				DuplicateColumns:    metric.DuplicateColumns,
+				Schemas:             metric.Schemas,
 			}
 		}
+		if err := metric.checkSampleLabel(); err != nil {
+			return fmt.Errorf("%w in collector %q", err, c.Name)
+		}
 	}
 
 	return checkOverflow(c.XXX, "collector")
 }
+
+// loadQueryFiles reads the queries defined in query files, resolving relative paths against baseDir (the directory of
+// the file defining the collector).
+func (c *CollectorConfig) loadQueryFiles(baseDir string) error {
+	for _, query := range c.Queries {
+		if err := query.loadQueryFile(baseDir); err != nil {
+			return fmt.Errorf("collector %q: %w", c.Name, err)
+		}
+	}
+	return nil
+}
@@ -28,6 +28,18 @@ var (
 	IgnoreMissingVals bool
 	DsnOverride       string
 	TargetLabel       string
+	InstanceLabel     string
+
+	PreparedStatementMetric bool
+	MaxLabelLength          int
+	QuerySQLHashMetric      bool
+	QueryInfoMetric         bool
+	QueryColumnsMetric      bool
+	ClampedValuesMetric     bool
+	StatementCacheMetrics   bool
+	ConnectionOpenMetric    bool
+	LastRowTimestampMetric  bool
+	DBVersionMetric         bool
 )
 
 // Load attempts to parse the given config file and return a Config object.
@@ -80,6 +92,13 @@ func (c *Config) UnmarshalYAML(unmarshal func(any) error) error {
 		return err
 	}
 
+	// Read the queries defined in query files by the collectors defined inline.
+	for _, cc := range c.Collectors {
+		if err := cc.loadQueryFiles(filepath.Dir(c.configFile)); err != nil {
+			return err
+		}
+	}
+
 	// Load any externally defined collectors.
 	if err := c.loadCollectorFiles(); err != nil {
 		return err
@@ -203,6 +222,9 @@ func (c *Config) loadCollectorFiles() error {
 			if err != nil {
 				return err
 			}
+			if err := cc.loadQueryFiles(filepath.Dir(cf)); err != nil {
+				return err
+			}
 
 			c.Collectors = append(c.Collectors, &cc)
 			slog.Debug("Loaded collector", "name", cc.Name, "file", cf)
@@ -3,6 +3,8 @@ package config
 import (
 	"reflect"
 	"testing"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestResolveCollectorRefs(t *testing.T) {
@@ -88,3 +90,114 @@ func TestResolveCollectorRefs(t *testing.T) {
 		}
 	})
 }
+
+func TestMetricConfigRowFilters(t *testing.T) {
+	t.Run("ContainsAnyWithValues", func(t *testing.T) {
+		m := MetricConfig{}
+		err := yaml.Unmarshal([]byte(`
+metric_name: m
+type: gauge
+help: h
+values: [v]
+query: SELECT 1 AS v
+row_filters:
+  - column: name
+    operator: contains_any
+    values: [foo, bar]
+`), &m)
+		if err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+	})
+
+	t.Run("ContainsAllWithoutValues", func(t *testing.T) {
+		m := MetricConfig{}
+		err := yaml.Unmarshal([]byte(`
+metric_name: m
+type: gauge
+help: h
+values: [v]
+query: SELECT 1 AS v
+row_filters:
+  - column: name
+    operator: contains_all
+    value: foo
+`), &m)
+		if err == nil {
+			t.Fatalf("expected error but got none")
+		}
+		expected := "row filter \"contains_all\" on column \"name\" of metric \"m\" requires values"
+		if err.Error() != expected {
+			t.Fatalf("expected err=%q but got err=%q", expected, err.Error())
+		}
+	})
+	t.Run("CompareColumnWithIn", func(t *testing.T) {
+		m := MetricConfig{}
+		err := yaml.Unmarshal([]byte(`
+metric_name: m
+type: gauge
+help: h
+values: [v]
+query: SELECT 1 AS v
+row_filters:
+  - column: current_value
+    operator: in
+    compare_column: threshold
+    values: ["1"]
+`), &m)
+		if err == nil {
+			t.Fatalf("expected error but got none")
+		}
+		expected := "row filter \"in\" on column \"current_value\" of metric \"m\" does not support compare_column"
+		if err.Error() != expected {
+			t.Fatalf("expected err=%q but got err=%q", expected, err.Error())
+		}
+	})
+
+	t.Run("NotBetweenWithReversedBounds", func(t *testing.T) {
+		m := MetricConfig{}
+		err := yaml.Unmarshal([]byte(`
+metric_name: m
+type: gauge
+help: h
+values: [v]
+query: SELECT 1 AS v
+row_filters:
+  - column: v
+    operator: not_between
+    values: ["10", "1"]
+`), &m)
+		if err == nil {
+			t.Fatalf("expected error but got none")
+		}
+		expected := "row filter \"not_between\" on column \"v\" of metric \"m\": low bound 10 is greater than high bound 1"
+		if err.Error() != expected {
+			t.Fatalf("expected err=%q but got err=%q", expected, err.Error())
+		}
+	})
+}
+
+func TestCollectorConfigSampleLabel(t *testing.T) {
+	c := CollectorConfig{}
+	err := yaml.Unmarshal([]byte(`
+collector_name: c
+metrics:
+  - metric_name: m
+    type: gauge
+    help: h
+    key_labels: [sample_rate]
+    values: [v]
+    query_ref: q
+queries:
+  - query_name: q
+    query: SELECT 1 AS v, 'x' AS sample_rate
+    sample_rate: 0.5
+`), &c)
+	if err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	expected := "label \"sample_rate\" of metric \"m\" is reserved for metrics populated from sampled queries in collector \"c\""
+	if err.Error() != expected {
+		t.Fatalf("expected err=%q but got err=%q", expected, err.Error())
+	}
+}
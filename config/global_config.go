@@ -14,10 +14,13 @@ type GlobalConfig struct {
 	TimeoutOffset           model.Duration `yaml:"scrape_timeout_offset" env:"SCRAPE_TIMEOUT_OFFSET"`           // offset to subtract from timeout in seconds
 	ScrapeErrorDropInterval model.Duration `yaml:"scrape_error_drop_interval" env:"SCRAPE_ERROR_DROP_INTERVAL"` // interval to drop scrape errors from the error counter, default is 0
 	MaxConnLifetime         time.Duration  `yaml:"max_connection_lifetime" env:"MAX_CONNECTION_LIFETIME"`       // maximum amount of time a connection may be reused to any one target
+	MaxConnIdleTime         time.Duration  `yaml:"max_connection_idle_time" env:"MAX_CONNECTION_IDLE_TIME"`     // maximum amount of time a connection may be idle before being closed
 
 	MaxConns     int `yaml:"max_connections" env:"MAX_CONNECTIONS"`           // maximum number of open connections to any one target
 	MaxIdleConns int `yaml:"max_idle_connections" env:"MAX_IDLE_CONNECTIONS"` // maximum number of idle connections to any one target
 
+	MaxQueriesPerSecond float64 `yaml:"max_queries_per_second,omitempty" env:"MAX_QUERIES_PER_SECOND"` // maximum rate of query executions across all targets, unlimited if 0
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]any `yaml:",inline" json:"-"`
 }
@@ -35,6 +38,7 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	g.MaxConns = 3
 	g.MaxIdleConns = 3
 	g.MaxConnLifetime = time.Duration(0)
+	g.MaxConnIdleTime = time.Duration(0)
 
 	type plain GlobalConfig
 	if err := unmarshal((*plain)(g)); err != nil {
@@ -44,6 +48,9 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if g.TimeoutOffset <= 0 {
 		return fmt.Errorf("global.scrape_timeout_offset must be strictly positive, have %s", g.TimeoutOffset)
 	}
+	if g.MaxQueriesPerSecond < 0 {
+		return fmt.Errorf("global.max_queries_per_second must not be negative, have %v", g.MaxQueriesPerSecond)
+	}
 
 	return checkOverflow(g.XXX, "global")
 }
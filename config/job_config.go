@@ -16,6 +16,8 @@ type JobConfig struct {
 
 	EnablePing *bool `yaml:"enable_ping,omitempty"` // ping the target before executing the collectors
 
+	TargetOptions `yaml:",inline"` // settings applied to all targets of the job
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]any `yaml:",inline" json:"-"`
 }
@@ -43,6 +45,13 @@ func (j *JobConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if len(j.StaticConfigs) == 0 {
 		return fmt.Errorf("no targets defined for job %q", j.Name)
 	}
+	// Connections are specific to a database server, they can't be shared by all targets of a job.
+	if len(j.Connections) > 0 {
+		return fmt.Errorf("connections are only supported by standalone targets, not by job %q", j.Name)
+	}
+	if err := j.checkLabels(fmt.Sprintf("job %q", j.Name)); err != nil {
+		return err
+	}
 
 	return checkOverflow(j.XXX, "job")
 }
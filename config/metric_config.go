@@ -2,53 +2,390 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 )
 
 // MetricConfig defines a Prometheus metric, the SQL query to populate it and the mapping of columns to metric
 // keys/values.
 type MetricConfig struct {
 	Name         string            `yaml:"metric_name"`             // the Prometheus metric name
+	Namespace    string            `yaml:"namespace,omitempty"`     // prefix of the metric name (and unknown_metric), joined with an underscore
 	TypeString   string            `yaml:"type"`                    // the Prometheus metric type
 	Help         string            `yaml:"help"`                    // the Prometheus metric help text
 	KeyLabels    []string          `yaml:"key_labels,omitempty"`    // expose these columns as labels from SQL
+	KeyDefaults  map[string]string `yaml:"key_defaults,omitempty"`  // label values for key columns the query may not return (e.g. older schemas)
 	StaticLabels map[string]string `yaml:"static_labels,omitempty"` // fixed key/value pairs as static labels
 	ValueLabel   string            `yaml:"value_label,omitempty"`   // with multiple value columns, map their names under this label
 	Values       []string          `yaml:"values"`                  // expose each of these columns as a value, keyed by column name
 	QueryLiteral string            `yaml:"query,omitempty"`         // a literal query
 	QueryRef     string            `yaml:"query_ref,omitempty"`     // references a query in the query map
 
-	NoPreparedStatement bool     `yaml:"no_prepared_statement,omitempty"` // do not prepare statement
-	StaticValue         *float64 `yaml:"static_value,omitempty"`
-	TimestampValue      string   `yaml:"timestamp_value,omitempty"` // optional column name containing a valid timestamp value
+	NoPreparedStatement bool           `yaml:"no_prepared_statement,omitempty"`    // do not prepare statement
+	SampleRate          float64        `yaml:"sample_rate,omitempty"`              // fraction of result rows to process, all rows if 0
+	Retries             int            `yaml:"retries,omitempty"`                  // times to retry the query on transient errors
+	RetryOnEmpty        int            `yaml:"retry_on_empty,omitempty"`           // times to retry the literal query when it returns no rows
+	LenientScan         bool           `yaml:"lenient_scan,omitempty"`             // scan columns one by one, dropping those that fail
+	CaseInsensitive     bool           `yaml:"case_insensitive_columns,omitempty"` // match result columns regardless of case
+	StrictColumns       bool           `yaml:"strict_columns,omitempty"`           // fail on columns not used by any metric
+	EmptyAsNull         []string       `yaml:"empty_as_null,omitempty"`            // key columns where empty strings are NULL
+	LogLevel            string         `yaml:"log_level,omitempty"`                // log level for the literal query, overriding the global one
+	Connection          string         `yaml:"connection,omitempty"`               // name of the target connection (e.g. a read replica) to run the literal query on
+	DatabaseLabel       string         `yaml:"database_label,omitempty"`           // label to carry the database name of the data source name in, for the literal query
+	SlowLogThreshold    model.Duration `yaml:"slow_log_threshold,omitempty"`       // log the details of executions of the literal query taking longer than this
+	TimeParams          []string       `yaml:"time_params,omitempty"`              // built-in time parameters to bind: scrape_time, interval_start
+	TimeParamsLayout    string         `yaml:"time_params_layout,omitempty"`       // bind time parameters as strings in this Go layout, or unix/unix_ms
+	MaxLabelLength      int            `yaml:"max_label_length,omitempty"`         // truncate longer key label values for the literal query, overriding the global limit
+	IgnoreMissingVals   *bool          `yaml:"ignore_missing_values,omitempty"`    // ignore results missing requested columns for the literal query, overriding the global flag
+	MissingValueDefault *float64       `yaml:"missing_value_default,omitempty"`    // value of requested value columns not returned by the literal query, instead of failing or ignoring the results
+	DuplicateColumns    string         `yaml:"duplicate_columns,omitempty"`        // on requested columns returned more than once by the literal query: error (default) or first
+	Schemas             *QuerySchemas  `yaml:"schemas,omitempty"`                  // run the literal query once per schema, labeling the metric with its name
+	StaticValue         *float64       `yaml:"static_value,omitempty"`
+	Info                bool           `yaml:"info,omitempty"`               // info-style gauge: one series of value 1 per row, labeled by its key columns
+	TimestampValue      string         `yaml:"timestamp_value,omitempty"`    // optional column name containing a valid timestamp value
+	InvalidTimestamp    string         `yaml:"invalid_timestamp,omitempty"`  // what to do when timestamp_value is NULL: skip (default), now or omit
+	TimestampLayout     string         `yaml:"timestamp_layout,omitempty"`   // Go layout or name of the format of timestamp_value, for timestamps returned as strings or epochs (unix, unix_ms)
+	TimestampTimezone   string         `yaml:"timestamp_timezone,omitempty"` // IANA zone assumed for timestamp_layout values without zone information, defaults to UTC
+	ResultSet           int            `yaml:"result_set,omitempty"`         // 0-based position of the result set to read, for queries returning several
+	SanitizeLabels      bool           `yaml:"sanitize_labels,omitempty"`    // replace invalid UTF-8 and strip control characters in label values
+	Reduce              string         `yaml:"reduce,omitempty"`             // without key labels, reduce all rows into one: first, sum, avg, min or max
+	HelpColumn          string         `yaml:"help_column,omitempty"`        // key column providing the help text (from the first row), help being the fallback
+	SplitSets           []string       `yaml:"split_sets,omitempty"`         // key labels holding MySQL SET values, exported as one series per member
+	RowLimit            int            `yaml:"row_limit,omitempty"`          // only the first this many rows passing the row filters produce metrics, all if 0
+	UnknownMetric       string         `yaml:"unknown_metric,omitempty"`     // gauge of value 1 emitted with the same labels in place of NULL values
+	SkipNullRows        bool           `yaml:"skip_null_rows,omitempty"`     // skip rows whose value columns are all NULL, unknown_metric included
+	IntervalValues      []string       `yaml:"interval_values,omitempty"`    // value columns returned as intervals (e.g. Postgres interval, MySQL TIME), scanned into seconds
 
 	// SHOW STATS filtering and transformation features
 	RowFilters      []RowFilter      `yaml:"row_filters,omitempty"`      // filter rows post-query
 	ColumnFilters   []string         `yaml:"column_filters,omitempty"`   // include only these columns
 	LagCalculations []LagCalculation `yaml:"lag_calculations,omitempty"` // calculate time lag for timestamp fields
+	ParsedValues    []ParsedValue    `yaml:"parsed_values,omitempty"`    // parse numeric values out of string columns
+	Coalesces       []Coalesce       `yaml:"coalesce,omitempty"`         // take the first non-NULL of several value columns
+	Percents        []Percent        `yaml:"percent,omitempty"`          // percentage of a part value column in a whole value column
+	Deltas          []Delta          `yaml:"deltas,omitempty"`           // difference with the value of the previous scrape
+	Buckets         []Bucketize      `yaml:"bucketize,omitempty"`        // map value columns to labels by thresholds
+	Durations       []Duration       `yaml:"durations,omitempty"`        // parse duration strings into seconds
+	Elapsed         []Elapsed        `yaml:"elapsed,omitempty"`          // time elapsed between two timestamp columns
+	Checksums       []Checksum       `yaml:"checksums,omitempty"`        // CRC32 checksum of string columns, for change detection
+	BinaryDigests   []BinaryDigest   `yaml:"binary_digests,omitempty"`   // CRC32 checksum or length of binary (e.g. bytea) columns
+	Flatten         *Flatten         `yaml:"flatten,omitempty"`          // one series per row of a name/value table
+	JSON            *JSONFields      `yaml:"json,omitempty"`             // one series per numeric field of a JSON document column
+	Distinct        *Distinct        `yaml:"distinct,omitempty"`         // without key labels, the number of distinct values of a column across all rows
+	Abs             []string         `yaml:"abs,omitempty"`              // value columns made absolute, after all other transformations but clamp and round
+	Clamps          []Clamp          `yaml:"clamp,omitempty"`            // limit value columns to a range, after abs and before round
+	Rounds          []Round          `yaml:"round,omitempty"`            // round value columns, after all other transformations
+	Splits          []Split          `yaml:"split,omitempty"`            // split delimited key/value strings into key columns
+	Composites      []Composite      `yaml:"composites,omitempty"`       // split PostgreSQL composite (row) columns into their fields
+	Masks           []Mask           `yaml:"masks,omitempty"`            // redact the parts of key label values matching a pattern
 
-	valueType prometheus.ValueType // TypeString converted to prometheus.ValueType
-	query     *QueryConfig         // QueryConfig resolved from QueryRef or generated from Query
+	valueType         prometheus.ValueType // TypeString converted to prometheus.ValueType
+	timestampLocation *time.Location       // TimestampTimezone loaded
+	query             *QueryConfig         // QueryConfig resolved from QueryRef or generated from Query
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]any `yaml:",inline" json:"-"`
 }
 
-// RowFilter defines conditions to filter rows after query execution
+// Reductions of multiple rows for metrics without key labels.
+const (
+	ReduceFirst = "first" // use the first row
+	ReduceSum   = "sum"   // sum the values of all rows
+	ReduceAvg   = "avg"   // average the values of all rows
+	ReduceMin   = "min"   // minimum of the values of all rows, e.g. the age of the newest row with lag_calculations
+	ReduceMax   = "max"   // maximum of the values of all rows, e.g. the age of the oldest row with lag_calculations
+)
+
+// Policies for samples whose timestamp_value is NULL or could not be scanned.
+const (
+	InvalidTimestampSkip = "skip" // drop the sample
+	InvalidTimestampNow  = "now"  // use the current time
+	InvalidTimestampOmit = "omit" // expose the sample without a timestamp
+)
+
+// RowFilter defines conditions to filter rows after query execution. Numeric (value) columns are compared in plain
+// decimal notation with as many digits as needed and no trailing zeros (e.g. "0", "1.5" or "100000000"), except for
+// equals, not_equals, in and not_in, which compare them numerically with values that are numbers (so "0.0" matches 0).
+// Time columns are compared in the trino format.
 type RowFilter struct {
-	Column   string   `yaml:"column"`           // column name to filter on
-	Operator string   `yaml:"operator"`         // "equals", "in", "not_in", "contains", "not_equals"
-	Value    string   `yaml:"value,omitempty"`  // single value for equals/not_equals/contains
-	Values   []string `yaml:"values,omitempty"` // multiple values for in/not_in
+	Column        string   `yaml:"column"`                   // column name to filter on
+	Operator      string   `yaml:"operator"`                 // "equals", "in", "not_in", "contains", "contains_any", "contains_all", "not_equals", "greater_than", "greater_or_equal", "less_than", "less_or_equal", "between", "not_between"
+	Value         string   `yaml:"value,omitempty"`          // single value for equals/not_equals/contains and numeric comparisons
+	Values        []string `yaml:"values,omitempty"`         // multiple values for in/not_in/contains_any/contains_all, [low, high] for between/not_between
+	CompareColumn string   `yaml:"compare_column,omitempty"` // compare against this column of the row instead of value
+
+	low, high float64 // Parsed between/not_between bounds
+}
+
+// Bounds returns the parsed [low, high] range of a between/not_between row filter.
+func (f *RowFilter) Bounds() (low, high float64) {
+	return f.low, f.high
 }
 
 // LagCalculation defines how to calculate time lag from timestamp fields
 type LagCalculation struct {
-	SourceColumn    string `yaml:"source_column"`              // column containing the timestamp (e.g., "high_value")
-	OutputColumn    string `yaml:"output_column"`              // new column name for the lag value (e.g., "lag_seconds")
-	TimestampFormat string `yaml:"timestamp_format,omitempty"` // format of timestamp, defaults to Trino format
+	SourceColumn    string   `yaml:"source_column"`              // column containing the timestamp (e.g., "high_value")
+	OutputColumn    string   `yaml:"output_column"`              // new column name for the lag value (e.g., "lag_seconds")
+	TimestampFormat string   `yaml:"timestamp_format,omitempty"` // Go layout or name of the timestamp format, defaults to trino
+	NullValue       *float64 `yaml:"null_value,omitempty"`       // lag for NULL timestamps (e.g. 0 or a -1 sentinel), no sample if unset
+	Timezone        string   `yaml:"timezone,omitempty"`         // IANA zone assumed for timestamps without zone information, defaults to UTC
+
+	location *time.Location // Timezone loaded
+}
+
+// Location returns the zone assumed for timestamps without zone information.
+func (l *LagCalculation) Location() *time.Location {
+	if l.location == nil {
+		return time.UTC
+	}
+	return l.location
+}
+
+// Elapsed defines an output value column populated with the time elapsed between a start and an end timestamp column,
+// NULL if either is NULL or can't be parsed.
+type Elapsed struct {
+	StartColumn     string `yaml:"start_column"`               // column containing the start timestamp
+	EndColumn       string `yaml:"end_column"`                 // column containing the end timestamp
+	OutputColumn    string `yaml:"output_column"`              // new column name for the elapsed time
+	Unit            string `yaml:"unit,omitempty"`             // unit of the elapsed time, one of ElapsedUnits, defaults to seconds
+	TimestampFormat string `yaml:"timestamp_format,omitempty"` // Go layout or name of the timestamp format, defaults to trino
+	Timezone        string `yaml:"timezone,omitempty"`         // IANA zone assumed for timestamps without zone information, defaults to UTC
+
+	location *time.Location // Timezone loaded
+}
+
+// ElapsedUnits maps the units usable for elapsed times to their durations.
+var ElapsedUnits = map[string]time.Duration{
+	"milliseconds": time.Millisecond,
+	"seconds":      time.Second,
+	"minutes":      time.Minute,
+	"hours":        time.Hour,
+	"days":         24 * time.Hour,
+}
+
+// Location returns the zone assumed for timestamps without zone information.
+func (e *Elapsed) Location() *time.Location {
+	if e.location == nil {
+		return time.UTC
+	}
+	return e.location
+}
+
+// TimestampFormats maps the names usable as timestamp_format to Go layouts. The unix and unix_ms formats, seconds and
+// milliseconds since the epoch, are parsed as numbers instead.
+var TimestampFormats = map[string]string{
+	"trino":          "2006-01-02 15:04:05.000 UTC",
+	"mysql_datetime": "2006-01-02 15:04:05",
+	"iso8601":        "2006-01-02T15:04:05Z07:00",
+	"rfc3339":        time.RFC3339Nano,
+}
+
+// Metric namespaces are metric names without colons, which are reserved for recording rules.
+var metricNamespace = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Timestamp format names look like identifiers, unlike Go layouts.
+var timestampFormatName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// TimestampLayout returns the Go layout of a timestamp format, resolving format names. The unix and unix_ms names are
+// returned as is.
+func TimestampLayout(format string) string {
+	if format == "" {
+		return TimestampFormats["trino"]
+	}
+	if layout, ok := TimestampFormats[format]; ok {
+		return layout
+	}
+	return format
+}
+
+// ParsedValue defines how to extract a numeric value from a string column
+type ParsedValue struct {
+	SourceColumn string   `yaml:"source_column"`     // string column containing the value (e.g., "latency" with "42ms")
+	OutputColumn string   `yaml:"output_column"`     // value column to write the parsed number to
+	Pattern      string   `yaml:"pattern,omitempty"` // regex to extract the number, the first capture group is used if any
+	Strip        []string `yaml:"strip,omitempty"`   // substrings to remove before parsing (e.g., "ms")
+	// Monetary amounts (e.g. "$1,234.56" or "(1.234,56 €)"): currency symbols and spaces are removed, parentheses mark
+	// negative amounts and the separators are those configured.
+	Money              bool   `yaml:"money,omitempty"`
+	ThousandsSeparator string `yaml:"thousands_separator,omitempty"` // with money, defaults to ","
+	DecimalSeparator   string `yaml:"decimal_separator,omitempty"`   // with money, defaults to "."
+
+	pattern *regexp.Regexp // Pattern compiled
+}
+
+// Regexp returns the compiled pattern, or nil if none was configured.
+func (p *ParsedValue) Regexp() *regexp.Regexp {
+	return p.pattern
+}
+
+// Coalesce defines an output value column populated from the first non-NULL of an ordered list of value columns
+type Coalesce struct {
+	SourceColumns []string `yaml:"source_columns"` // value columns to pick from, in order of preference
+	OutputColumn  string   `yaml:"output_column"`  // new column name for the picked value
+}
+
+// Percent defines an output value column populated with the percentage of a part value column in a whole value column,
+// NULL if the whole is zero.
+type Percent struct {
+	PartColumn   string `yaml:"part_column"`     // value column holding the part
+	WholeColumn  string `yaml:"whole_column"`    // value column holding the whole
+	OutputColumn string `yaml:"output_column"`   // new column name for the percentage
+	Clamp        bool   `yaml:"clamp,omitempty"` // clamp the percentage to [0, 100]
+}
+
+// Delta defines an output value column populated with the increase of a value column since the previous scrape. On a
+// decrease (i.e. a counter reset) the new value is used as is.
+type Delta struct {
+	SourceColumn string `yaml:"source_column"` // cumulative value column
+	OutputColumn string `yaml:"output_column"` // new column name for the delta
+}
+
+// Bucketize defines an output key column populated with the label of the bucket a value column falls in: the first
+// bucket whose upper boundary is greater than or equal to the value, or the last label for values above all boundaries.
+type Bucketize struct {
+	SourceColumn string    `yaml:"source_column"` // value column to bucketize (e.g., "latency_ms")
+	OutputColumn string    `yaml:"output_column"` // new key column name for the bucket label (e.g., "latency_class")
+	Boundaries   []float64 `yaml:"boundaries"`    // upper boundaries of the buckets, in increasing order (e.g., [10, 100])
+	Labels       []string  `yaml:"labels"`        // one label per bucket plus one above the highest boundary (e.g., [fast, medium, slow])
+}
+
+// Duration defines an output value column populated with the number of seconds of a duration string column, either in
+// ISO-8601 (e.g. "PT1H30M") or Go (e.g. "1h30m") format. ISO-8601 years and months are counted as 365 and 30 days.
+type Duration struct {
+	SourceColumn string `yaml:"source_column"` // string column containing the duration
+	OutputColumn string `yaml:"output_column"` // new column name for the seconds
+}
+
+// Checksum defines an output value column populated with the CRC32 (IEEE) checksum of a string column, so the value
+// changes whenever the content does (e.g. to alert on `changes()`).
+type Checksum struct {
+	SourceColumn string `yaml:"source_column"` // string column to checksum
+	OutputColumn string `yaml:"output_column"` // new column name for the checksum
+}
+
+// Composite defines output columns populated from the fields of a PostgreSQL composite (row) column, returned as a
+// literal like `(42,"eu west",t)`. Fields are mapped by position to the output columns, those among the metric values
+// being parsed as numbers (t and f as 1 and 0) and the others being key columns. Empty fields are NULL, as are all
+// fields of a NULL or malformed composite.
+type Composite struct {
+	SourceColumn string   `yaml:"source_column"` // composite column
+	Fields       []string `yaml:"fields"`        // output column of each field in order, empty to skip a field
+}
+
+// Mask defines the redaction of a key label value, e.g. the local part of an email address. The parts of the value
+// matching the pattern are replaced with the replacement, in which $1 or ${name} expand to the captured groups (so
+// `^[^@]+` keeps the domain of the address). Row filters and other transformations see the value unmasked.
+type Mask struct {
+	Column      string `yaml:"column"`                // key label column whose values to mask
+	Pattern     string `yaml:"pattern"`               // regex matching the parts to redact
+	Replacement string `yaml:"replacement,omitempty"` // replacement of the matched parts, defaults to DefaultMaskReplacement
+
+	pattern *regexp.Regexp // Pattern compiled
+}
+
+// Regexp returns the compiled pattern.
+func (m *Mask) Regexp() *regexp.Regexp {
+	return m.pattern
+}
+
+// Default replacement of masked parts of label values.
+const DefaultMaskReplacement = "***"
+
+// Split defines output key columns populated from a string column of delimited key/value pairs, e.g. "region=us,tier=prod".
+// Segments without a separator are ignored and keys missing from the string leave their output column NULL.
+type Split struct {
+	SourceColumn string            `yaml:"source_column"`       // string column holding the key/value pairs
+	Delimiter    string            `yaml:"delimiter,omitempty"` // separates pairs, defaults to ","
+	Separator    string            `yaml:"separator,omitempty"` // separates each key from its value, defaults to "="
+	Keys         map[string]string `yaml:"keys"`                // maps keys in the string to the output key columns
+}
+
+// Clamp defines a value column limited in place to a range, e.g. to guard against outliers from sensor glitches. NULL
+// values are left NULL.
+type Clamp struct {
+	Column string   `yaml:"column"`        // value column to clamp
+	Min    *float64 `yaml:"min,omitempty"` // lower bound, none if unset
+	Max    *float64 `yaml:"max,omitempty"` // upper bound, none if unset
+}
+
+// Round defines a value column rounded in place, after all other transformations, either to a number of decimal places
+// or to the nearest multiple of a step. NULL values are left NULL.
+type Round struct {
+	Column   string  `yaml:"column"`             // value column to round
+	Decimals int     `yaml:"decimals,omitempty"` // decimal places to keep, negative to round to tens, hundreds etc.
+	Multiple float64 `yaml:"multiple,omitempty"` // round to a multiple of this instead (e.g. 0.25)
+	Truncate bool    `yaml:"truncate,omitempty"` // truncate towards zero instead of rounding half away from zero
+}
+
+// BinaryDigest defines an output value column populated with the CRC32 (IEEE) checksum or the length in bytes of a
+// binary column (e.g. a bytea blob). The digest is computed as the column is scanned, the content itself is not kept.
+type BinaryDigest struct {
+	SourceColumn string `yaml:"source_column"`      // binary column to digest
+	OutputColumn string `yaml:"output_column"`      // new column name for the digest
+	Function     string `yaml:"function,omitempty"` // crc32 (default) or length
+}
+
+// Binary digest functions.
+const (
+	BinaryDigestCRC32  = "crc32"
+	BinaryDigestLength = "length"
+)
+
+// Flatten defines a metric populated from name/value rows (e.g. a settings table), with one series per row labeled
+// with the name and valued with the value. Rows with non-numeric values are skipped.
+type Flatten struct {
+	NameColumn  string   `yaml:"name_column"`       // column holding the name (e.g., "setting_name")
+	ValueColumn string   `yaml:"value_column"`      // column holding the value (e.g., "setting_value")
+	Label       string   `yaml:"label,omitempty"`   // label to expose the name under, defaults to name_column
+	Include     []string `yaml:"include,omitempty"` // only expose rows with these names, all if empty
+}
+
+// Default max_values of distinct, further values not being counted.
+const DefaultDistinctMaxValues = 10000
+
+// Distinct defines a gauge valued with the number of distinct non-NULL values of a column across the rows of the
+// result set, i.e. a COUNT(DISTINCT) computed by the exporter. At most max_values values are tracked, a column with
+// more being reported as having max_values distinct values.
+type Distinct struct {
+	Column    string `yaml:"column"`               // column whose distinct values to count
+	MaxValues int    `yaml:"max_values,omitempty"` // maximum number of values tracked, defaults to DefaultDistinctMaxValues
+}
+
+// Default max_depth of json, deeper fields being skipped.
+const DefaultJSONMaxDepth = 8
+
+// JSONFields defines a metric populated from a JSON document column (e.g. a PostgreSQL jsonb), with one series per
+// numeric field labeled with its path. Object keys are joined with the separator and array elements are addressed by
+// their index, so {"pool": {"active": 3}, "replicas": [{"lag": 2}]} exports pool.active and replicas.0.lag. Booleans
+// are exported as 1 or 0, strings and nulls are skipped.
+type JSONFields struct {
+	Column    string   `yaml:"column"`              // column holding the JSON document
+	Label     string   `yaml:"label,omitempty"`     // label to expose the field path under, defaults to "path"
+	Separator string   `yaml:"separator,omitempty"` // separator of path elements, defaults to "."
+	Include   []string `yaml:"include,omitempty"`   // only expose fields with these paths, all if empty
+	MaxDepth  int      `yaml:"max_depth,omitempty"` // skip fields nested deeper than this, defaults to DefaultJSONMaxDepth
+}
+
+// PrefixedName returns the name of the metric, or of its unknown_metric, prefixed with the namespace if any.
+func (m *MetricConfig) PrefixedName(name string) string {
+	if m.Namespace == "" {
+		return name
+	}
+	return m.Namespace + "_" + name
+}
+
+// TimestampLocation returns the zone assumed for timestamp_layout values without zone information.
+func (m *MetricConfig) TimestampLocation() *time.Location {
+	if m.timestampLocation == nil {
+		return time.UTC
+	}
+	return m.timestampLocation
 }
 
 // ValueType returns the metric type, converted to a prometheus.ValueType.
@@ -74,12 +411,182 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if err := m.setValueType(); err != nil {
 		return err
 	}
+	if err := m.validateFlatten(); err != nil {
+		return err
+	}
+	if err := m.validateJSON(); err != nil {
+		return err
+	}
+	if err := m.validateDistinct(); err != nil {
+		return err
+	}
 	if err := m.validateKeyLabels(); err != nil {
 		return err
 	}
 	if err := m.validateValues(); err != nil {
 		return err
 	}
+	if err := checkSampleRate(m.SampleRate, "metric", m.Name); err != nil {
+		return err
+	}
+	if m.Retries < 0 || m.RetryOnEmpty < 0 {
+		return fmt.Errorf("retries and retry_on_empty must not be negative for metric %q", m.Name)
+	}
+	if err := checkLogLevel(m.LogLevel, "metric", m.Name); err != nil {
+		return err
+	}
+	if m.DatabaseLabel != "" {
+		if err := checkLabel(m.DatabaseLabel, "database_label for metric", m.Name); err != nil {
+			return err
+		}
+	}
+	if err := checkTimeParams(m.TimeParams, "metric", m.Name); err != nil {
+		return err
+	}
+	if err := checkDuplicateColumns(m.DuplicateColumns, "metric", m.Name); err != nil {
+		return err
+	}
+	if err := checkSchemas(m.Schemas, "metric", m.Name); err != nil {
+		return err
+	}
+	if m.MaxLabelLength < 0 {
+		return fmt.Errorf("max_label_length must not be negative for metric %q", m.Name)
+	}
+	if err := m.validateInvalidTimestamp(); err != nil {
+		return err
+	}
+	if err := m.validateTimestampLayout(); err != nil {
+		return err
+	}
+	if err := m.validateUnknownMetric(); err != nil {
+		return err
+	}
+	if m.Namespace != "" && !metricNamespace.MatchString(m.Namespace) {
+		return fmt.Errorf("invalid namespace %q for metric %q, must match %s", m.Namespace, m.Name, metricNamespace)
+	}
+	if err := m.validateReduce(); err != nil {
+		return err
+	}
+	if m.RowLimit < 0 {
+		return fmt.Errorf("row_limit must not be negative for metric %q", m.Name)
+	}
+	if m.ResultSet < 0 {
+		return fmt.Errorf("result_set must not be negative for metric %q", m.Name)
+	}
+	if err := m.validateRowFilters(); err != nil {
+		return err
+	}
+	if err := m.validateParsedValues(); err != nil {
+		return err
+	}
+	if err := m.validateMasks(); err != nil {
+		return err
+	}
+	if err := m.validateCoalesces(); err != nil {
+		return err
+	}
+	for _, p := range m.Percents {
+		if p.PartColumn == "" || p.WholeColumn == "" || p.OutputColumn == "" {
+			return fmt.Errorf("part_column, whole_column and output_column must be defined for percent of metric %q", m.Name)
+		}
+	}
+	if err := m.validateBuckets(); err != nil {
+		return err
+	}
+	for i := range m.LagCalculations {
+		lc := &m.LagCalculations[i]
+		switch f := lc.TimestampFormat; {
+		case f == TimeLayoutUnix || f == TimeLayoutUnixMilli:
+		case timestampFormatName.MatchString(f) && TimestampFormats[f] == "":
+			return fmt.Errorf("unknown timestamp_format %q for lag calculation of column %q in metric %q", f, lc.SourceColumn, m.Name)
+		}
+		if lc.Timezone != "" {
+			loc, err := time.LoadLocation(lc.Timezone)
+			if err != nil {
+				return fmt.Errorf("invalid timezone for lag calculation of column %q in metric %q: %w", lc.SourceColumn, m.Name, err)
+			}
+			lc.location = loc
+		}
+	}
+	if err := m.validateElapsed(); err != nil {
+		return err
+	}
+	for _, col := range m.Abs {
+		if !slices.Contains(m.Values, col) {
+			return fmt.Errorf("abs column %q is not a value of metric %q", col, m.Name)
+		}
+	}
+	for _, col := range m.IntervalValues {
+		if !slices.Contains(m.Values, col) {
+			return fmt.Errorf("interval_values column %q is not a value of metric %q", col, m.Name)
+		}
+	}
+	for _, c := range m.Clamps {
+		switch {
+		case !slices.Contains(m.Values, c.Column):
+			return fmt.Errorf("clamp column %q is not a value of metric %q", c.Column, m.Name)
+		case c.Min == nil && c.Max == nil:
+			return fmt.Errorf("min or max must be defined for clamp of column %q in metric %q", c.Column, m.Name)
+		case c.Min != nil && c.Max != nil && *c.Min > *c.Max:
+			return fmt.Errorf("clamp min of column %q in metric %q is greater than max", c.Column, m.Name)
+		}
+	}
+	if err := m.validateRounds(); err != nil {
+		return err
+	}
+	for col := range m.KeyDefaults {
+		if !slices.Contains(m.KeyLabels, col) {
+			return fmt.Errorf("key_defaults column %q is not a key label of metric %q", col, m.Name)
+		}
+	}
+	for _, col := range m.SplitSets {
+		if !slices.Contains(m.KeyLabels, col) {
+			return fmt.Errorf("split_sets column %q is not a key label of metric %q", col, m.Name)
+		}
+	}
+	for _, d := range m.Deltas {
+		if d.SourceColumn == "" || d.OutputColumn == "" {
+			return fmt.Errorf("source_column and output_column must be defined for deltas of metric %q", m.Name)
+		}
+	}
+	for _, d := range m.Durations {
+		if d.SourceColumn == "" || d.OutputColumn == "" {
+			return fmt.Errorf("source_column and output_column must be defined for durations of metric %q", m.Name)
+		}
+	}
+	for i := range m.Splits {
+		s := &m.Splits[i]
+		if s.SourceColumn == "" || len(s.Keys) == 0 {
+			return fmt.Errorf("source_column and keys must be defined for split of metric %q", m.Name)
+		}
+		if s.Delimiter == "" {
+			s.Delimiter = ","
+		}
+		if s.Separator == "" {
+			s.Separator = "="
+		}
+	}
+	for _, c := range m.Composites {
+		if c.SourceColumn == "" || !slices.ContainsFunc(c.Fields, func(f string) bool { return f != "" }) {
+			return fmt.Errorf("source_column and fields must be defined for composites of metric %q", m.Name)
+		}
+	}
+	for _, d := range m.BinaryDigests {
+		if d.SourceColumn == "" || d.OutputColumn == "" {
+			return fmt.Errorf("source_column and output_column must be defined for binary_digests of metric %q", m.Name)
+		}
+		switch d.Function {
+		case "", BinaryDigestCRC32, BinaryDigestLength:
+		default:
+			return fmt.Errorf("unsupported binary_digests function %q for metric %q, must be one of %q or %q", d.Function, m.Name,
+				BinaryDigestCRC32, BinaryDigestLength)
+		}
+	}
+	for _, c := range m.Checksums {
+		if c.SourceColumn == "" || c.OutputColumn == "" {
+			return fmt.Errorf("source_column and output_column must be defined for checksums of metric %q", m.Name)
+		}
+	}
 
 	return checkOverflow(m.XXX, "metric")
 }
@@ -130,6 +637,12 @@ func (m *MetricConfig) validateKeyLabels() error {
 		if m.ValueLabel == li {
 			return fmt.Errorf("duplicate label %q (defined in both key_labels and value_label) for metric %q", li, m.Name)
 		}
+		if m.Flatten != nil && m.Flatten.Label == li {
+			return fmt.Errorf("duplicate label %q (defined in both key_labels and flatten) for metric %q", li, m.Name)
+		}
+		if m.JSON != nil && m.JSON.Label == li {
+			return fmt.Errorf("duplicate label %q (defined in both key_labels and json) for metric %q", li, m.Name)
+		}
 	}
 
 	return nil
@@ -137,6 +650,41 @@ func (m *MetricConfig) validateKeyLabels() error {
 
 // Check for duplicate values
 func (m *MetricConfig) validateValues() error {
+	if m.SkipNullRows && len(m.Values) == 0 {
+		return fmt.Errorf("skip_null_rows requires values for metric %q", m.Name)
+	}
+
+	if m.Flatten != nil {
+		if len(m.Values) > 0 || m.StaticValue != nil || m.Info {
+			return fmt.Errorf("metric %q cannot have both flatten and values, static_value or info defined", m.Name)
+		}
+		return nil
+	}
+	if m.JSON != nil {
+		if len(m.Values) > 0 || m.StaticValue != nil || m.Info {
+			return fmt.Errorf("metric %q cannot have both json and values, static_value or info defined", m.Name)
+		}
+		return nil
+	}
+	if m.Distinct != nil {
+		if len(m.Values) > 0 || m.StaticValue != nil || m.Info {
+			return fmt.Errorf("metric %q cannot have both distinct and values, static_value or info defined", m.Name)
+		}
+		return nil
+	}
+
+	if m.Info {
+		if len(m.Values) > 0 || m.StaticValue != nil {
+			return fmt.Errorf("metric %q cannot have both info and values or static_value defined", m.Name)
+		}
+		if m.valueType != prometheus.GaugeValue {
+			return fmt.Errorf("info metric %q must be a gauge", m.Name)
+		}
+		one := 1.0
+		m.StaticValue = &one
+		return nil
+	}
+
 	if len(m.Values) == 0 && m.StaticValue == nil {
 		return fmt.Errorf("no values defined for metric %q", m.Name)
 	}
@@ -157,3 +705,351 @@ func (m *MetricConfig) validateValues() error {
 
 	return nil
 }
+
+// Check the policy for invalid timestamps
+func (m *MetricConfig) validateInvalidTimestamp() error {
+	switch m.InvalidTimestamp {
+	case "":
+		return nil
+	case InvalidTimestampSkip, InvalidTimestampNow, InvalidTimestampOmit:
+	default:
+		return fmt.Errorf("unsupported invalid_timestamp %q for metric %q, must be one of %q, %q or %q", m.InvalidTimestamp,
+			m.Name, InvalidTimestampSkip, InvalidTimestampNow, InvalidTimestampOmit)
+	}
+	if m.TimestampValue == "" {
+		return fmt.Errorf("invalid_timestamp requires timestamp_value for metric %q", m.Name)
+	}
+
+	return nil
+}
+
+// Check the layout of timestamps returned as strings
+func (m *MetricConfig) validateTimestampLayout() error {
+	switch f := m.TimestampLayout; {
+	case f == "" && m.TimestampTimezone != "":
+		return fmt.Errorf("timestamp_timezone requires timestamp_layout for metric %q", m.Name)
+	case f == "":
+		return nil
+	case m.TimestampValue == "":
+		return fmt.Errorf("timestamp_layout requires timestamp_value for metric %q", m.Name)
+	case f == TimeLayoutUnix || f == TimeLayoutUnixMilli:
+	case timestampFormatName.MatchString(f) && TimestampFormats[f] == "":
+		return fmt.Errorf("unknown timestamp_layout %q for metric %q", f, m.Name)
+	}
+	if m.TimestampTimezone != "" {
+		loc, err := time.LoadLocation(m.TimestampTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp_timezone for metric %q: %w", m.Name, err)
+		}
+		m.timestampLocation = loc
+	}
+
+	return nil
+}
+
+// Check the companion metric of NULL values
+func (m *MetricConfig) validateUnknownMetric() error {
+	switch {
+	case m.UnknownMetric == "":
+		return nil
+	case len(m.Values) == 0:
+		return fmt.Errorf("unknown_metric requires values for metric %q", m.Name)
+	case m.UnknownMetric == m.Name:
+		return fmt.Errorf("unknown_metric must differ from the name of metric %q", m.Name)
+	}
+
+	return nil
+}
+
+// Check the labels of a metric populated from a sampled query leave the sample label to the exporter, once the query
+// is resolved
+func (m *MetricConfig) checkSampleLabel() error {
+	if qc := m.query; qc == nil || qc.SampleRate <= 0 || qc.SampleRate >= 1 {
+		return nil
+	}
+	_, static := m.StaticLabels[SampleLabel]
+	if static || slices.Contains(m.KeyLabels, SampleLabel) || m.ValueLabel == SampleLabel {
+		return fmt.Errorf("label %q of metric %q is reserved for metrics populated from sampled queries", SampleLabel, m.Name)
+	}
+
+	return nil
+}
+
+// Check the reduction of multiple rows
+func (m *MetricConfig) validateReduce() error {
+	switch m.Reduce {
+	case "":
+		return nil
+	case ReduceFirst, ReduceSum, ReduceAvg, ReduceMin, ReduceMax:
+	default:
+		return fmt.Errorf("unsupported reduce %q for metric %q, must be one of %q, %q, %q, %q or %q", m.Reduce, m.Name,
+			ReduceFirst, ReduceSum, ReduceAvg, ReduceMin, ReduceMax)
+	}
+	if len(m.KeyLabels) > 0 || m.Flatten != nil || m.JSON != nil {
+		return fmt.Errorf("reduce is not supported with key_labels, flatten or json for metric %q", m.Name)
+	}
+
+	return nil
+}
+
+// Check row filters have the operands their operator requires
+func (m *MetricConfig) validateRowFilters() error {
+	for i := range m.RowFilters {
+		filter := &m.RowFilters[i]
+		switch filter.Operator {
+		case "contains_any", "contains_all":
+			if len(filter.Values) == 0 {
+				return fmt.Errorf("row filter %q on column %q of metric %q requires values", filter.Operator, filter.Column, m.Name)
+			}
+		case "between", "not_between":
+			low, high, err := filterBounds(filter.Values)
+			if err != nil {
+				return fmt.Errorf("row filter %q on column %q of metric %q: %w", filter.Operator, filter.Column, m.Name, err)
+			}
+			filter.low, filter.high = low, high
+		}
+		if filter.CompareColumn == "" {
+			continue
+		}
+		switch filter.Operator {
+		case "in", "not_in", "contains_any", "contains_all", "between", "not_between":
+			return fmt.Errorf("row filter %q on column %q of metric %q does not support compare_column", filter.Operator, filter.Column, m.Name)
+		}
+		if filter.Value != "" {
+			return fmt.Errorf("row filter on column %q of metric %q cannot have both value and compare_column", filter.Column, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// filterBounds returns the inclusive numeric range of a between/not_between row filter, given as [low, high].
+func filterBounds(values []string) (low, high float64, err error) {
+	if len(values) != 2 {
+		return 0, 0, fmt.Errorf("requires exactly two values (low and high), have %d", len(values))
+	}
+	if low, err = strconv.ParseFloat(values[0], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid low bound: %w", err)
+	}
+	if high, err = strconv.ParseFloat(values[1], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid high bound: %w", err)
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("low bound %v is greater than high bound %v", low, high)
+	}
+	return low, high, nil
+}
+
+// Check parsed values and compile their patterns
+func (m *MetricConfig) validateParsedValues() error {
+	for i := range m.ParsedValues {
+		pv := &m.ParsedValues[i]
+		if pv.SourceColumn == "" || pv.OutputColumn == "" {
+			return fmt.Errorf("source_column and output_column must be defined for parsed_values of metric %q", m.Name)
+		}
+		if pv.Money {
+			if pv.DecimalSeparator == "" {
+				pv.DecimalSeparator = "."
+			}
+			if pv.ThousandsSeparator == "" {
+				pv.ThousandsSeparator = ","
+				if pv.DecimalSeparator == "," {
+					pv.ThousandsSeparator = "."
+				}
+			}
+			if pv.ThousandsSeparator == pv.DecimalSeparator {
+				return fmt.Errorf("thousands_separator and decimal_separator must differ in parsed_values of metric %q", m.Name)
+			}
+		} else if pv.ThousandsSeparator != "" || pv.DecimalSeparator != "" {
+			return fmt.Errorf("thousands_separator and decimal_separator require money in parsed_values of metric %q", m.Name)
+		}
+		if pv.Pattern != "" {
+			re, err := regexp.Compile(pv.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q in parsed_values of metric %q: %w", pv.Pattern, m.Name, err)
+			}
+			pv.pattern = re
+		}
+	}
+
+	return nil
+}
+
+// Check masks apply to key labels, compiling their patterns
+func (m *MetricConfig) validateMasks() error {
+	for i := range m.Masks {
+		mk := &m.Masks[i]
+		if !slices.Contains(m.KeyLabels, mk.Column) {
+			return fmt.Errorf("mask column %q is not a key label of metric %q", mk.Column, m.Name)
+		}
+		if mk.Pattern == "" {
+			return fmt.Errorf("pattern must be defined for mask of column %q in metric %q", mk.Column, m.Name)
+		}
+		re, err := regexp.Compile(mk.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q for mask of column %q in metric %q: %w", mk.Pattern, mk.Column, m.Name, err)
+		}
+		mk.pattern = re
+		if mk.Replacement == "" {
+			mk.Replacement = DefaultMaskReplacement
+		}
+	}
+
+	return nil
+}
+
+// Check elapsed time transformations, loading their timezones
+func (m *MetricConfig) validateElapsed() error {
+	for i := range m.Elapsed {
+		e := &m.Elapsed[i]
+		if e.StartColumn == "" || e.EndColumn == "" || e.OutputColumn == "" {
+			return fmt.Errorf("start_column, end_column and output_column must be defined for elapsed of metric %q", m.Name)
+		}
+		if e.Unit == "" {
+			e.Unit = "seconds"
+		}
+		if _, ok := ElapsedUnits[e.Unit]; !ok {
+			return fmt.Errorf("unsupported unit %q for elapsed of column %q in metric %q", e.Unit, e.OutputColumn, m.Name)
+		}
+		switch f := e.TimestampFormat; {
+		case f == TimeLayoutUnix || f == TimeLayoutUnixMilli:
+		case timestampFormatName.MatchString(f) && TimestampFormats[f] == "":
+			return fmt.Errorf("unknown timestamp_format %q for elapsed of column %q in metric %q", f, e.OutputColumn, m.Name)
+		}
+		if e.Timezone != "" {
+			loc, err := time.LoadLocation(e.Timezone)
+			if err != nil {
+				return fmt.Errorf("invalid timezone for elapsed of column %q in metric %q: %w", e.OutputColumn, m.Name, err)
+			}
+			e.location = loc
+		}
+	}
+
+	return nil
+}
+
+// Check coalesce transformations
+func (m *MetricConfig) validateCoalesces() error {
+	for _, c := range m.Coalesces {
+		if len(c.SourceColumns) == 0 || c.OutputColumn == "" {
+			return fmt.Errorf("source_columns and output_column must be defined for coalesce of metric %q", m.Name)
+		}
+	}
+
+	return nil
+}
+
+// Check bucketize transformations have ordered boundaries and a label for each bucket
+func (m *MetricConfig) validateBuckets() error {
+	for _, b := range m.Buckets {
+		if b.SourceColumn == "" || b.OutputColumn == "" {
+			return fmt.Errorf("source_column and output_column must be defined for bucketize of metric %q", m.Name)
+		}
+		if len(b.Boundaries) == 0 || len(b.Labels) != len(b.Boundaries)+1 {
+			return fmt.Errorf("bucketize of column %q in metric %q requires boundaries and one more label than boundaries",
+				b.SourceColumn, m.Name)
+		}
+		for i := 1; i < len(b.Boundaries); i++ {
+			if b.Boundaries[i] <= b.Boundaries[i-1] {
+				return fmt.Errorf("bucketize boundaries of column %q in metric %q must be strictly increasing", b.SourceColumn, m.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check rounded columns are values and have a single precision
+func (m *MetricConfig) validateRounds() error {
+	for _, r := range m.Rounds {
+		if !slices.Contains(m.Values, r.Column) {
+			return fmt.Errorf("round column %q is not a value of metric %q", r.Column, m.Name)
+		}
+		if r.Multiple < 0 {
+			return fmt.Errorf("round multiple of column %q in metric %q must not be negative", r.Column, m.Name)
+		}
+		if r.Multiple != 0 && r.Decimals != 0 {
+			return fmt.Errorf("round of column %q in metric %q cannot have both decimals and multiple defined", r.Column, m.Name)
+		}
+	}
+
+	return nil
+}
+
+// Check the flatten transformation and default its label
+func (m *MetricConfig) validateFlatten() error {
+	f := m.Flatten
+	if f == nil {
+		return nil
+	}
+	if f.NameColumn == "" || f.ValueColumn == "" {
+		return fmt.Errorf("name_column and value_column must be defined for flatten of metric %q", m.Name)
+	}
+	if f.NameColumn == f.ValueColumn {
+		return fmt.Errorf("name_column and value_column must differ for flatten of metric %q", m.Name)
+	}
+	if f.Label == "" {
+		f.Label = f.NameColumn
+	}
+	if m.ValueLabel != "" {
+		return fmt.Errorf("value_label is not supported with flatten for metric %q", m.Name)
+	}
+
+	return checkLabel(f.Label, "flatten label for metric", m.Name)
+}
+
+// Check the distinct count and default its maximum number of values
+func (m *MetricConfig) validateDistinct() error {
+	d := m.Distinct
+	if d == nil {
+		return nil
+	}
+	if d.Column == "" {
+		return fmt.Errorf("column must be defined for distinct of metric %q", m.Name)
+	}
+	switch {
+	case d.MaxValues < 0:
+		return fmt.Errorf("max_values must not be negative for distinct of metric %q", m.Name)
+	case d.MaxValues == 0:
+		d.MaxValues = DefaultDistinctMaxValues
+	}
+	if m.valueType != prometheus.GaugeValue {
+		return fmt.Errorf("distinct metric %q must be a gauge", m.Name)
+	}
+	if len(m.KeyLabels) > 0 || m.Flatten != nil || m.JSON != nil || m.Reduce != "" || m.ValueLabel != "" {
+		return fmt.Errorf("distinct is not supported with key_labels, flatten, json, reduce or value_label for metric %q", m.Name)
+	}
+
+	return nil
+}
+
+// Check the json extraction and default its label, separator and depth
+func (m *MetricConfig) validateJSON() error {
+	j := m.JSON
+	if j == nil {
+		return nil
+	}
+	if m.Flatten != nil {
+		return fmt.Errorf("metric %q cannot have both flatten and json defined", m.Name)
+	}
+	if j.Column == "" {
+		return fmt.Errorf("column must be defined for json of metric %q", m.Name)
+	}
+	if j.Label == "" {
+		j.Label = "path"
+	}
+	if j.Separator == "" {
+		j.Separator = "."
+	}
+	switch {
+	case j.MaxDepth < 0:
+		return fmt.Errorf("max_depth must not be negative for json of metric %q", m.Name)
+	case j.MaxDepth == 0:
+		j.MaxDepth = DefaultJSONMaxDepth
+	}
+	if m.ValueLabel != "" {
+		return fmt.Errorf("value_label is not supported with json for metric %q", m.Name)
+	}
+
+	return checkLabel(j.Label, "json label for metric", m.Name)
+}
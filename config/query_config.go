@@ -1,13 +1,46 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// SampleLabel is the label added to metrics populated from a sampled query, set to the sample rate.
+const SampleLabel = "sample_rate"
 
 // QueryConfig defines a named query, to be referenced by one or multiple metrics.
 type QueryConfig struct {
 	Name  string `yaml:"query_name"` // the query name, to be referenced via `query_ref`
 	Query string `yaml:"query"`      // the named query
 
-	NoPreparedStatement bool `yaml:"no_prepared_statement,omitempty"` // do not prepare statement
+	QueryFile string `yaml:"query_file,omitempty"` // file to read the query from instead, relative to the file defining it
+
+	NoPreparedStatement bool           `yaml:"no_prepared_statement,omitempty"`    // do not prepare statement
+	SampleRate          float64        `yaml:"sample_rate,omitempty"`              // fraction of result rows to process, all rows if 0
+	Retries             int            `yaml:"retries,omitempty"`                  // times to retry the query on transient errors
+	RetryOnEmpty        int            `yaml:"retry_on_empty,omitempty"`           // times to retry the query when it returns no rows
+	LenientScan         bool           `yaml:"lenient_scan,omitempty"`             // scan columns one by one, dropping those that fail
+	CaseInsensitive     bool           `yaml:"case_insensitive_columns,omitempty"` // match result columns regardless of case
+	StrictColumns       bool           `yaml:"strict_columns,omitempty"`           // fail on columns not used by any metric
+	EmptyAsNull         []string       `yaml:"empty_as_null,omitempty"`            // key columns where empty strings are NULL
+	LogLevel            string         `yaml:"log_level,omitempty"`                // log level for this query, overriding the global one
+	Connection          string         `yaml:"connection,omitempty"`               // name of the target connection (e.g. a read replica) to run on, the main one if empty
+	DatabaseLabel       string         `yaml:"database_label,omitempty"`           // label to carry the database name of the data source name in
+	SlowLogThreshold    model.Duration `yaml:"slow_log_threshold,omitempty"`       // log the details of executions taking longer than this
+	TimeParams          []string       `yaml:"time_params,omitempty"`              // built-in time parameters to bind: scrape_time, interval_start
+	TimeParamsLayout    string         `yaml:"time_params_layout,omitempty"`       // bind time parameters as strings in this Go layout, or unix/unix_ms
+	MaxLabelLength      int            `yaml:"max_label_length,omitempty"`         // truncate longer key label values, overriding the global limit
+	IgnoreMissingVals   *bool          `yaml:"ignore_missing_values,omitempty"`    // ignore results missing requested columns, overriding the global flag
+	MissingValueDefault *float64       `yaml:"missing_value_default,omitempty"`    // value of requested value columns not returned, instead of failing or ignoring the results
+	DuplicateColumns    string         `yaml:"duplicate_columns,omitempty"`        // on requested columns returned more than once: error (default) or first
+
+	ParamsFrom *QueryParams  `yaml:"params_from,omitempty"` // run once per value returned by another query
+	Schemas    *QuerySchemas `yaml:"schemas,omitempty"`     // run once per schema, labeling the metrics with its name
 
 	metrics []*MetricConfig // metrics referencing this query
 
@@ -26,11 +59,191 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if q.Name == "" {
 		return fmt.Errorf("missing name for query %+v", *q)
 	}
-	if q.Query == "" {
-		return fmt.Errorf("missing query literal for query %q", q.Name)
+	if (q.Query == "") == (q.QueryFile == "") {
+		return fmt.Errorf("exactly one of query and query_file must be specified for query %q", q.Name)
+	}
+
+	if err := checkSampleRate(q.SampleRate, "query", q.Name); err != nil {
+		return err
+	}
+
+	if q.ParamsFrom != nil {
+		if q.ParamsFrom.QueryRef == "" || q.ParamsFrom.Column == "" {
+			return fmt.Errorf("query_ref and column must be defined for params_from of query %q", q.Name)
+		}
+		if q.ParamsFrom.QueryRef == q.Name {
+			return fmt.Errorf("params_from of query %q references itself", q.Name)
+		}
+		if q.ParamsFrom.MaxFanOut <= 0 {
+			q.ParamsFrom.MaxFanOut = DefaultMaxFanOut
+		}
+	}
+	if q.Retries < 0 || q.RetryOnEmpty < 0 {
+		return fmt.Errorf("retries and retry_on_empty must not be negative for query %q", q.Name)
+	}
+	if q.Schemas != nil && q.ParamsFrom != nil {
+		return fmt.Errorf("query %q cannot have both schemas and params_from defined", q.Name)
+	}
+	if err := checkSchemas(q.Schemas, "query", q.Name); err != nil {
+		return err
+	}
+	if err := checkLogLevel(q.LogLevel, "query", q.Name); err != nil {
+		return err
+	}
+	if q.DatabaseLabel != "" {
+		if err := checkLabel(q.DatabaseLabel, "database_label for query", q.Name); err != nil {
+			return err
+		}
+	}
+	if err := checkTimeParams(q.TimeParams, "query", q.Name); err != nil {
+		return err
+	}
+	if err := checkDuplicateColumns(q.DuplicateColumns, "query", q.Name); err != nil {
+		return err
+	}
+	if q.MaxLabelLength < 0 {
+		return fmt.Errorf("max_label_length must not be negative for query %q", q.Name)
 	}
 
 	q.metrics = make([]*MetricConfig, 0, 2)
 
 	return checkOverflow(q.XXX, "metric")
 }
+
+// DefaultMaxFanOut is the default maximum number of parameter values a query with params_from is run with.
+const DefaultMaxFanOut = 100
+
+// QueryParams defines another query of the same collector whose results are bound as the parameter of a query, which
+// is then run once per returned value. Metrics populated by such a query should carry the parameter as a label (e.g.
+// `SELECT $1 AS tenant, ...`) to tell the runs apart.
+type QueryParams struct {
+	QueryRef  string `yaml:"query_ref"`             // named query providing the parameter values
+	Column    string `yaml:"column"`                // column of the referenced query holding the values
+	MaxFanOut int    `yaml:"max_fan_out,omitempty"` // maximum number of values, the query fails if exceeded
+
+	query *QueryConfig // QueryConfig resolved from QueryRef
+}
+
+// Query returns the query referenced by QueryRef.
+func (p *QueryParams) Query() *QueryConfig {
+	return p.query
+}
+
+// SchemaPlaceholder is replaced with the schema name in the SQL of queries with schemas.
+const SchemaPlaceholder = "{{schema}}"
+
+// DefaultMaxSchemas is the default maximum number of schemas a query with schemas is run in.
+const DefaultMaxSchemas = 100
+
+// QuerySchemas defines the schemas a query is run in, one after the other, with SchemaPlaceholder in its SQL replaced
+// with the schema name (e.g. `SELECT count(*) AS orders FROM {{schema}}.orders`). The schema name is injected as a label
+// of its metrics. Schemas are either listed or returned by a discovery query, and only names that are plain
+// identifiers are used, as they're spliced into the SQL. A schema failing doesn't stop the others.
+type QuerySchemas struct {
+	Names      []string `yaml:"names,omitempty"`       // schemas to run the query in
+	Query      string   `yaml:"query,omitempty"`       // discovery query returning the schema names in its first column, instead of names
+	Label      string   `yaml:"label,omitempty"`       // label carrying the schema name, defaults to "schema"
+	MaxSchemas int      `yaml:"max_schemas,omitempty"` // maximum number of schemas, the query fails if exceeded
+}
+
+// checkSchemas checks that the schemas of a query are listed or discovered, defaulting their label and bound.
+func checkSchemas(s *QuerySchemas, ctx, name string) error {
+	if s == nil {
+		return nil
+	}
+	if (len(s.Names) == 0) == (s.Query == "") {
+		return fmt.Errorf("exactly one of names and query must be specified for schemas of %s %q", ctx, name)
+	}
+	if s.Label == "" {
+		s.Label = "schema"
+	}
+	switch {
+	case s.MaxSchemas < 0:
+		return fmt.Errorf("max_schemas must not be negative for %s %q", ctx, name)
+	case s.MaxSchemas == 0:
+		s.MaxSchemas = DefaultMaxSchemas
+	}
+	if len(s.Names) > s.MaxSchemas {
+		return fmt.Errorf("more than max_schemas (%d) schemas listed for %s %q", s.MaxSchemas, ctx, name)
+	}
+	return checkLabel(s.Label, "schemas label for", ctx, name)
+}
+
+// checkSampleRate checks that a sample rate is a valid fraction.
+func checkSampleRate(rate float64, ctx, name string) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1 for %s %q, have %v", ctx, name, rate)
+	}
+	return nil
+}
+
+// Built-in time parameters and layouts.
+const (
+	TimeParamScrapeTime    = "scrape_time"    // the time the query is run at
+	TimeParamIntervalStart = "interval_start" // the scrape time of the previous run, or the scrape time on the first run
+	TimeLayoutUnix         = "unix"           // seconds since the epoch
+	TimeLayoutUnixMilli    = "unix_ms"        // milliseconds since the epoch
+)
+
+// Policies for requested columns returned more than once by a query.
+const (
+	DuplicateColumnsError = "error" // fail the query
+	DuplicateColumnsFirst = "first" // use the first occurrence, ignoring the others
+)
+
+// checkDuplicateColumns checks the policy for duplicate columns is known.
+func checkDuplicateColumns(policy, ctx, name string) error {
+	switch policy {
+	case "", DuplicateColumnsError, DuplicateColumnsFirst:
+		return nil
+	default:
+		return fmt.Errorf("unsupported duplicate_columns %q for %s %q, must be one of %q or %q", policy, ctx, name,
+			DuplicateColumnsError, DuplicateColumnsFirst)
+	}
+}
+
+// checkTimeParams checks that all time parameters are known.
+func checkTimeParams(params []string, ctx, name string) error {
+	for _, param := range params {
+		switch param {
+		case TimeParamScrapeTime, TimeParamIntervalStart:
+		default:
+			return fmt.Errorf("unsupported time parameter %q for %s %q", param, ctx, name)
+		}
+	}
+	return nil
+}
+
+// checkLogLevel checks that a log level is empty or one of debug, info, warn or error.
+func checkLogLevel(level, ctx, name string) error {
+	if level == "" {
+		return nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log_level %q for %s %q: %w", level, ctx, name, err)
+	}
+	return nil
+}
+
+// loadQueryFile reads the query from its query_file, if any. Environment variables in the path are expanded and
+// relative paths are resolved against baseDir.
+func (q *QueryConfig) loadQueryFile(baseDir string) error {
+	if q.QueryFile == "" {
+		return nil
+	}
+	path := os.ExpandEnv(q.QueryFile)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read query_file of query %q: %w", q.Name, err)
+	}
+	if strings.TrimSpace(string(buf)) == "" {
+		return fmt.Errorf("query_file %s of query %q is empty", path, q.Name)
+	}
+	q.Query = string(buf)
+	slog.Debug("Loaded query", "name", q.Name, "file", path)
+	return nil
+}
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/prometheus/common/model"
 )
 
 //
@@ -24,6 +27,8 @@ type TargetConfig struct {
 	CollectorRefs []string `yaml:"collectors" env:"COLLECTORS"`             // names of collectors to execute on the target
 	EnablePing    *bool    `yaml:"enable_ping,omitempty" env:"ENABLE_PING"` // ping the target before executing the collectors
 
+	TargetOptions `yaml:",inline"` // settings shared with job targets
+
 	collectors []*CollectorConfig // resolved collector references
 
 	// Catches all undefined fields and must be empty after parsing.
@@ -53,10 +58,172 @@ func (t *TargetConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if err := checkCollectorRefs(t.CollectorRefs, "target"); err != nil {
 		return err
 	}
+	if err := t.checkLabels("target"); err != nil {
+		return err
+	}
 
 	return checkOverflow(t.XXX, "target")
 }
 
+// TargetOptions defines settings applicable to any target, whether configured standalone or as part of a job.
+type TargetOptions struct {
+	ApplicationName   string            `yaml:"application_name,omitempty" env:"APPLICATION_NAME"`             // application name reported to the database, for drivers supporting it
+	AzureAuth         *AzureAuthConfig  `yaml:"azure_auth,omitempty" env:", prefix=AZURE_AUTH_"`               // authenticate with Azure AD access tokens
+	Compression       bool              `yaml:"compression,omitempty" env:"COMPRESSION"`                       // request compressed responses (ClickHouse, Trino)
+	ConnAttributes    map[string]string `yaml:"connection_attributes,omitempty" env:"CONNECTION_ATTRIBUTES"`   // attributes identifying the connections in audit logs (MySQL)
+	Connections       map[string]Secret `yaml:"connections,omitempty" env:"CONNECTIONS"`                       // additional named data source names (e.g. read replicas) queries may be routed to
+	InitSQL           []string          `yaml:"init_sql,omitempty" env:"INIT_SQL"`                             // statements that must succeed on each new connection (e.g. USE WAREHOUSE)
+	KeepGoing         bool              `yaml:"keep_going,omitempty" env:"KEEP_GOING"`                         // record query errors without failing the scrape
+	Labels            map[string]string `yaml:"labels,omitempty" env:"LABELS"`                                 // labels to apply to all metrics of the target, beneath their static_labels
+	MaxQueriesPerSec  float64           `yaml:"max_queries_per_second,omitempty" env:"MAX_QUERIES_PER_SECOND"` // maximum rate of query executions against the target, on top of the global limit
+	QueryFilter       *QueryFilter      `yaml:"query_filter,omitempty" env:", prefix=QUERY_FILTER_"`           // enable or disable queries by name
+	RequireEncryption bool              `yaml:"require_encryption,omitempty" env:"REQUIRE_ENCRYPTION"`         // fail the target unless its connections are encrypted (Postgres, MySQL, SQL Server)
+	ScrapeInterval    model.Duration    `yaml:"scrape_interval,omitempty" env:"SCRAPE_INTERVAL"`               // abort scrapes running longer than this, to not overlap the next one
+	SessionSettings   []string          `yaml:"session_settings,omitempty" env:"SESSION_SETTINGS"`             // statements to execute on each new connection
+	StatementCache    bool              `yaml:"statement_cache,omitempty" env:"STATEMENT_CACHE"`               // have the driver cache parsed statements, e.g. for no_prepared_statement queries (pgx)
+	ValidateConns     bool              `yaml:"validate_connections,omitempty" env:"VALIDATE_CONNECTIONS"`     // ping pooled connections before reuse, discarding broken ones
+	Vault             *VaultConfig      `yaml:"vault,omitempty" env:", prefix=VAULT_"`                         // read the password from HashiCorp Vault
+	VersionQuery      string            `yaml:"version_query,omitempty" env:"VERSION_QUERY"`                   // query returning the database server version, exported as sql_exporter_db_version_info
+}
+
+// checkLabels checks the target labels, which may not redefine the labels set by the exporter.
+func (o *TargetOptions) checkLabels(ctx string) error {
+	for name := range o.Labels {
+		if err := checkLabel(name, ctx, "labels"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryFilter selects the queries to run on a target, by name (i.e. `query_name`, or the metric name for literal
+// queries). Patterns are matched with filepath.Match, disabled patterns take precedence over enabled ones.
+type QueryFilter struct {
+	Enabled  []string `yaml:"enabled,omitempty" env:"ENABLED"`   // only run queries matching these patterns, all if empty
+	Disabled []string `yaml:"disabled,omitempty" env:"DISABLED"` // never run queries matching these patterns
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]any `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for QueryFilter.
+func (f *QueryFilter) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain QueryFilter
+	if err := unmarshal((*plain)(f)); err != nil {
+		return err
+	}
+
+	for _, pattern := range slices.Concat(f.Enabled, f.Disabled) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad query pattern %q in query_filter: %w", pattern, err)
+		}
+	}
+
+	return checkOverflow(f.XXX, "query_filter")
+}
+
+// Allows returns whether the named query is to be run. A nil QueryFilter allows all queries.
+func (f *QueryFilter) Allows(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, pattern := range f.Disabled {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(f.Enabled) == 0 {
+		return true
+	}
+	for _, pattern := range f.Enabled {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Azure AD authentication modes.
+const (
+	AzureAuthModeDefault         = "default"
+	AzureAuthModeManagedIdentity = "managed_identity"
+)
+
+// AzureAuthConfig enables Azure AD (Entra ID) authentication: an access token is fetched (and refreshed before expiry)
+// and used as the password of each new connection.
+type AzureAuthConfig struct {
+	Mode     string `yaml:"mode,omitempty" env:"MODE"`           // "default" (credential chain) or "managed_identity"
+	ClientID string `yaml:"client_id,omitempty" env:"CLIENT_ID"` // client ID of a user-assigned managed identity
+	Scope    string `yaml:"scope,omitempty" env:"SCOPE"`         // token scope, defaults to Azure Database for PostgreSQL/MySQL
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]any `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for AzureAuthConfig.
+func (a *AzureAuthConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain AzureAuthConfig
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+
+	switch a.Mode {
+	case "", AzureAuthModeDefault, AzureAuthModeManagedIdentity:
+	default:
+		return fmt.Errorf("unsupported azure_auth mode %q", a.Mode)
+	}
+
+	return checkOverflow(a.XXX, "azure_auth")
+}
+
+// Vault auth methods and defaults.
+const (
+	VaultAuthToken           = "token"
+	VaultAuthAppRole         = "approle"
+	VaultDefaultAppRoleMount = "approle"
+	VaultDefaultField        = "password"
+)
+
+// VaultConfig enables reading the password of new connections from a HashiCorp Vault secret (e.g. KV or database
+// secrets engine). The secret is read again when its lease is about to expire.
+type VaultConfig struct {
+	Address      string `yaml:"address,omitempty" env:"ADDRESS"`             // Vault address, defaults to $VAULT_ADDR
+	Namespace    string `yaml:"namespace,omitempty" env:"NAMESPACE"`         // Vault Enterprise namespace
+	Path         string `yaml:"path" env:"PATH"`                             // API path of the secret (e.g. "secret/data/db" or "database/creds/role")
+	Field        string `yaml:"field,omitempty" env:"FIELD"`                 // field of the secret holding the password, defaults to "password"
+	AuthMethod   string `yaml:"auth_method,omitempty" env:"AUTH_METHOD"`     // "token" (default) or "approle"
+	Token        Secret `yaml:"token,omitempty" env:"TOKEN"`                 // token auth, defaults to $VAULT_TOKEN
+	RoleID       string `yaml:"role_id,omitempty" env:"ROLE_ID"`             // AppRole role ID
+	SecretID     Secret `yaml:"secret_id,omitempty" env:"SECRET_ID"`         // AppRole secret ID
+	AppRoleMount string `yaml:"approle_mount,omitempty" env:"APPROLE_MOUNT"` // mount path of the AppRole auth method, defaults to "approle"
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]any `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for VaultConfig.
+func (v *VaultConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain VaultConfig
+	if err := unmarshal((*plain)(v)); err != nil {
+		return err
+	}
+
+	if v.Path == "" {
+		return fmt.Errorf("missing path for vault")
+	}
+	switch v.AuthMethod {
+	case "", VaultAuthToken:
+	case VaultAuthAppRole:
+		if v.RoleID == "" || v.SecretID == "" {
+			return fmt.Errorf("role_id and secret_id must be defined for vault auth_method %q", v.AuthMethod)
+		}
+	default:
+		return fmt.Errorf("unsupported vault auth_method %q", v.AuthMethod)
+	}
+
+	return checkOverflow(v.XXX, "vault")
+}
+
 // AWS Secret
 type AwsSecret struct {
 	DSN Secret `json:"data_source_name"`
@@ -52,7 +52,7 @@ func checkLabel(label string, ctx ...string) error {
 	if label == "" {
 		return fmt.Errorf("empty label defined in %s", strings.Join(ctx, " "))
 	}
-	if label == "job" || label == TargetLabel {
+	if label == "job" || label == TargetLabel || (InstanceLabel != "" && label == InstanceLabel) {
 		return fmt.Errorf("reserved label %q redefined in %s", label, strings.Join(ctx, " "))
 	}
 	return nil
@@ -0,0 +1,136 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/burningalchemist/sql_exporter/errors"
+)
+
+// DebugValue is a column value of a query result row, as scanned for metrics.
+type DebugValue struct {
+	Type  string `json:"type"`  // how the column is scanned: key, value, time or binary
+	Value any    `json:"value"` // the scanned value, nil for NULL
+}
+
+// DebugQuery runs the named query on the named target (empty in single target mode) and returns its first maxRows
+// rows, with the columns requested by its metrics as scanned for them. It's meant for troubleshooting queries, as it
+// exposes the raw data.
+func DebugQuery(ctx context.Context, e Exporter, targetName, queryName string, maxRows int) ([]map[string]DebugValue, error) {
+	exp, ok := e.(*exporter)
+	if !ok {
+		return nil, fmt.Errorf("unsupported exporter type %T", e)
+	}
+	for _, tt := range exp.targets {
+		t, ok := tt.(*target)
+		if !ok || t.name != targetName {
+			continue
+		}
+		q := t.query(queryName)
+		if q == nil {
+			return nil, fmt.Errorf("query %q not found for target %q", queryName, targetName)
+		}
+		if err := t.ping(ctx); err != nil {
+			return nil, err
+		}
+		conn := t.conn
+		if name := q.config.Connection; name != "" {
+			conn = t.replicas[name]
+		}
+		rows, err := q.sample(ctx, conn, maxRows)
+		if err != nil {
+			return nil, err
+		}
+		return debugRows(rows), nil
+	}
+	return nil, fmt.Errorf("target %q not found", targetName)
+}
+
+// query returns the target's query with the given name, or nil if none.
+func (t *target) query(name string) *Query {
+	for _, c := range t.collectors {
+		var raw *collector
+		switch c := c.(type) {
+		case *collector:
+			raw = c
+		case *cachingCollector:
+			raw = c.rawColl
+		}
+		if raw == nil {
+			continue
+		}
+		for _, q := range raw.queries {
+			if q.config.Name == name {
+				return q
+			}
+		}
+	}
+	return nil
+}
+
+// sample runs the query and returns its first maxRows rows as scanned for metrics, before any filtering or
+// transformation.
+func (q *Query) sample(ctx context.Context, conn *sql.DB, maxRows int) (_ []map[string]any, werr errors.WithContext) {
+	if q.config.ParamsFrom != nil || q.config.Schemas != nil {
+		return nil, errors.Errorf(q.logContext, "queries with params_from or schemas are not supported")
+	}
+
+	rows, err := q.run(ctx, conn, "", q.timeParamValues(time.Now())...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dest, err := q.scanDest(rows)
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]any
+	for len(result) < maxRows && rows.Next() {
+		row, err := q.scanRow(rows, dest)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(q.logContext, err)
+	}
+	return result, nil
+}
+
+// debugRows converts scanned rows into their debugging representation.
+func debugRows(rows []map[string]any) []map[string]DebugValue {
+	result := make([]map[string]DebugValue, 0, len(rows))
+	for _, row := range rows {
+		dr := make(map[string]DebugValue, len(row))
+		for column, value := range row {
+			switch v := value.(type) {
+			case sql.NullString:
+				dr[column] = DebugValue{Type: "key"}
+				if v.Valid {
+					dr[column] = DebugValue{Type: "key", Value: v.String}
+				}
+			case sql.NullFloat64:
+				dr[column] = DebugValue{Type: "value"}
+				if v.Valid {
+					dr[column] = DebugValue{Type: "value", Value: v.Float64}
+				}
+			case sql.NullTime:
+				dr[column] = DebugValue{Type: "time"}
+				if v.Valid {
+					dr[column] = DebugValue{Type: "time", Value: v.Time}
+				}
+			case binaryDigest:
+				dr[column] = DebugValue{Type: "binary"}
+				if v.Valid {
+					dr[column] = DebugValue{Type: "binary", Value: fmt.Sprintf("%d bytes, crc32 %08x", v.Length, v.CRC32)}
+				}
+			}
+		}
+		result = append(result, dr)
+	}
+	return result
+}
@@ -0,0 +1,37 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// encryptionQueries maps driver names to a query returning whether the current connection is encrypted (with TLS), as
+// a boolean-like value.
+var encryptionQueries = map[string]string{
+	"postgres": "SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()",
+	"pgx":      "SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()",
+	"mysql": "SELECT VARIABLE_VALUE <> '' FROM performance_schema.session_status " +
+		"WHERE VARIABLE_NAME = 'Ssl_cipher'",
+	"sqlserver": "SELECT encrypt_option FROM sys.dm_exec_connections WHERE session_id = @@SPID",
+}
+
+// checkEncryption returns whether the target's connections are encrypted, as reported by the database for one of them,
+// exporting the result in the connection encrypted metric. The query is subject to the rate limits of the target and
+// those carried by ctx.
+func (t *target) checkEncryption(ctx context.Context) (bool, error) {
+	if _, err := waitRateLimits(withRateLimiter(ctx, t.rateLimiter)); err != nil {
+		return false, err
+	}
+	var encrypted sql.NullString
+	if err := t.conn.QueryRowContext(ctx, t.encryptionQuery).Scan(&encrypted); err != nil {
+		return false, err
+	}
+	// Postgres returns t/f, MySQL 1/0 and SQL Server TRUE/FALSE.
+	value := strings.ToLower(strings.TrimSpace(encrypted.String))
+	isEncrypted := encrypted.Valid && (value == "t" || value == "1" || value == "true")
+	if connectionEncryptedMetric != nil {
+		connectionEncryptedMetric.WithLabelValues(t.jobGroup, t.name).Set(boolToFloat64(isEncrypted))
+	}
+	return isEncrypted, nil
+}
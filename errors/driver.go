@@ -0,0 +1,122 @@
+package errors
+
+import (
+	"errors"
+	"reflect"
+)
+
+// Normalized reasons of driver errors, see DriverReason.
+const (
+	ReasonAuth               = "auth_failed"
+	ReasonConnection         = "connection"
+	ReasonTooManyConnections = "too_many_connections"
+	ReasonPermission         = "permission_denied"
+	ReasonDeadlock           = "deadlock"
+	ReasonLockTimeout        = "lock_timeout"
+	ReasonCanceled           = "canceled"
+	ReasonResources          = "insufficient_resources"
+	ReasonSyntax             = "syntax"
+	ReasonOther              = "other"
+)
+
+// sqlStateReasons maps SQLSTATE codes, then their 2 character classes, to normalized reasons.
+var sqlStateReasons = map[string]string{
+	"53300": ReasonTooManyConnections,
+	"42501": ReasonPermission,
+	"40001": ReasonDeadlock,
+	"40P01": ReasonDeadlock,
+	"55P03": ReasonLockTimeout,
+	"57014": ReasonCanceled,
+	"28":    ReasonAuth,
+	"08":    ReasonConnection,
+	"53":    ReasonResources,
+	"42":    ReasonSyntax,
+}
+
+// errorNumberReasons maps vendor error numbers (MySQL, SQL Server) to normalized reasons, for drivers without SQLSTATE.
+var errorNumberReasons = map[int64]string{
+	1045:  ReasonAuth,               // MySQL ER_ACCESS_DENIED_ERROR
+	1040:  ReasonTooManyConnections, // MySQL ER_CON_COUNT_ERROR
+	1044:  ReasonPermission,         // MySQL ER_DBACCESS_DENIED_ERROR
+	1142:  ReasonPermission,         // MySQL ER_TABLEACCESS_DENIED_ERROR
+	1213:  ReasonDeadlock,           // MySQL ER_LOCK_DEADLOCK
+	1205:  ReasonLockTimeout,        // MySQL ER_LOCK_WAIT_TIMEOUT (the same number is a deadlock victim on SQL Server)
+	1064:  ReasonSyntax,             // MySQL ER_PARSE_ERROR
+	18456: ReasonAuth,               // SQL Server login failed
+	229:   ReasonPermission,         // SQL Server permission denied
+}
+
+// DriverReason returns the normalized reason of a database driver error wrapped by err and its SQLSTATE (if the
+// driver reports one), or ok false if err doesn't wrap a driver error exposing a code. Drivers are told apart by the
+// shape of their errors rather than their types, so as not to depend on them: a SQLState() method (pgx, lib/pq), a
+// SQLState field (MySQL, Snowflake) or a Number field or SQLErrorNumber() method (MySQL, SQL Server).
+func DriverReason(err error) (reason, sqlState string, ok bool) {
+	var number int64
+	hasNumber := false
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if s, isStater := e.(interface{ SQLState() string }); isStater {
+			sqlState = s.SQLState()
+		}
+		if n, isNumberer := e.(interface{ SQLErrorNumber() int32 }); isNumberer {
+			number, hasNumber = int64(n.SQLErrorNumber()), true
+		}
+		if v := reflect.Indirect(reflect.ValueOf(e)); v.Kind() == reflect.Struct {
+			if sqlState == "" {
+				sqlState = stringField(v, "SQLState")
+			}
+			if !hasNumber {
+				number, hasNumber = intField(v, "Number")
+			}
+		}
+		if sqlState != "" || hasNumber {
+			break
+		}
+	}
+
+	switch {
+	case sqlState != "" && sqlStateReasons[sqlState] != "":
+		return sqlStateReasons[sqlState], sqlState, true
+	case len(sqlState) == 5 && sqlStateReasons[sqlState[:2]] != "":
+		return sqlStateReasons[sqlState[:2]], sqlState, true
+	case hasNumber && errorNumberReasons[number] != "":
+		return errorNumberReasons[number], sqlState, true
+	case sqlState != "" || hasNumber:
+		return ReasonOther, sqlState, true
+	}
+	return "", "", false
+}
+
+// stringField returns the value of the named string (or byte array, e.g. a MySQL SQLSTATE) field of v, if any.
+func stringField(v reflect.Value, name string) string {
+	f := v.FieldByName(name)
+	switch {
+	case !f.IsValid():
+		return ""
+	case f.Kind() == reflect.String:
+		return f.String()
+	case f.Kind() == reflect.Array && f.Type().Elem().Kind() == reflect.Uint8 && f.Len() > 0:
+		b := make([]byte, f.Len())
+		for i := range b {
+			b[i] = byte(f.Index(i).Uint())
+		}
+		if b[0] == 0 {
+			return ""
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// intField returns the value of the named integer field of v, if any.
+func intField(v reflect.Value, name string) (int64, bool) {
+	f := v.FieldByName(name)
+	switch {
+	case !f.IsValid():
+		return 0, false
+	case f.CanInt():
+		return f.Int(), true
+	case f.CanUint():
+		return int64(f.Uint()), true
+	}
+	return 0, false
+}
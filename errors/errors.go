@@ -1,9 +1,24 @@
 package errors
 
 import (
+	"context"
+	"errors"
 	"fmt"
 )
 
+// Category classifies errors by the stage they happened at, e.g. to tell connection errors from query errors.
+type Category string
+
+// Error categories.
+const (
+	CategoryUnknown    Category = "unknown"
+	CategoryConfig     Category = "config"     // invalid configuration
+	CategoryConnection Category = "connection" // opening or pinging the database
+	CategoryQuery      Category = "query"      // preparing or executing a query
+	CategoryScan       Category = "scan"       // mapping the query results to metrics
+	CategoryTimeout    Category = "timeout"    // the scrape context was canceled or timed out
+)
+
 // WithContext is an error associated with a logging context string (e.g. `job="foo", instance="bar"`). It is formatted
 // as:
 //
@@ -14,22 +29,25 @@ type WithContext interface {
 	Context() string
 	RawError() error
 	Unwrap() error
+	// Category returns the category of the error, see CategoryOf.
+	Category() Category
 }
 
 // withContext implements WithContext.
 type withContext struct {
-	context string
-	err     error
+	context  string
+	err      error
+	category Category
 }
 
 // New creates a new WithContext.
 func New(context string, err string) WithContext {
-	return &withContext{context, fmt.Errorf(err)}
+	return &withContext{context: context, err: fmt.Errorf(err)}
 }
 
 // Errorf formats according to a format specifier and returns a new WithContext.
 func Errorf(context, format string, a ...any) WithContext {
-	return &withContext{context, fmt.Errorf(format, a...)}
+	return &withContext{context: context, err: fmt.Errorf(format, a...)}
 }
 
 // Wrap returns a WithContext wrapping err. If err is nil, it returns nil. If err is a WithContext, it is returned
@@ -41,7 +59,7 @@ func Wrap(context string, err error) WithContext {
 	if w, ok := err.(WithContext); ok {
 		return w
 	}
-	return &withContext{context, err}
+	return &withContext{context: context, err: err}
 }
 
 // Wrapf returns a WithContext that prepends a formatted message to err.Error(). If err is nil, it returns nil. If err
@@ -56,9 +74,43 @@ func Wrapf(context string, err error, format string, a ...any) WithContext {
 		prefix = fmt.Sprintf(format, a...)
 	}
 	if w, ok := err.(WithContext); ok {
-		return &withContext{w.Context(), fmt.Errorf("%s: %w", prefix, w.RawError())}
+		return &withContext{context: w.Context(), err: fmt.Errorf("%s: %w", prefix, w.RawError()), category: categoryOf(w)}
+	}
+	return &withContext{context: context, err: err}
+}
+
+// Categorize returns a WithContext with the same context and error as err, classified under category. If err is nil,
+// it returns nil. If err is already classified, it is returned unchanged (the innermost category being more specific).
+func Categorize(err WithContext, category Category) WithContext {
+	if err == nil {
+		return nil
+	}
+	if categoryOf(err) != "" {
+		return err
 	}
-	return &withContext{context, err}
+	return &withContext{context: err.Context(), err: err.RawError(), category: category}
+}
+
+// CategoryOf returns the category of err: CategoryTimeout for context errors, else the one it was classified under or
+// CategoryUnknown.
+func CategoryOf(err error) Category {
+	// Whatever it was doing, an operation interrupted by the context is a timeout.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return CategoryTimeout
+	}
+	var w *withContext
+	if errors.As(err, &w) && w.category != "" {
+		return w.category
+	}
+	return CategoryUnknown
+}
+
+// categoryOf returns the category err was classified under, if any.
+func categoryOf(err WithContext) Category {
+	if w, ok := err.(*withContext); ok {
+		return w.category
+	}
+	return ""
 }
 
 // Error implements error.
@@ -79,6 +131,11 @@ func (w *withContext) RawError() error {
 	return w.err
 }
 
+// Category implements WithContext.
+func (w *withContext) Category() Category {
+	return CategoryOf(w)
+}
+
 // Unwrap implements WithContext.
 func (w *withContext) Unwrap() error {
 	return fmt.Errorf("[%s] %w", w.context, w.err)
@@ -9,6 +9,7 @@ import (
 	"sync"
 
 	"github.com/burningalchemist/sql_exporter/config"
+	sqlerrors "github.com/burningalchemist/sql_exporter/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 
@@ -16,9 +17,28 @@ import (
 )
 
 var (
-	SvcRegistry        = prometheus.NewRegistry()
-	svcMetricLabels    = []string{"job", "target", "collector", "query"}
-	scrapeErrorsMetric *prometheus.CounterVec
+	SvcRegistry                = prometheus.NewRegistry()
+	svcMetricLabels            = []string{"job", "target", "collector", "query"}
+	scrapeErrorsMetric         *prometheus.CounterVec
+	errorsByCategoryMetric     *prometheus.CounterVec
+	driverErrorsMetric         *prometheus.CounterVec
+	columnScanErrorsMetric     *prometheus.CounterVec
+	queryColumnsMetric         *prometheus.GaugeVec
+	lastRowTimestampMetric     *prometheus.GaugeVec
+	connectionOpenMetric       *prometheus.GaugeVec
+	targetConnectedMetric      *prometheus.GaugeVec
+	connectionEncryptedMetric  *prometheus.GaugeVec
+	clampedValuesMetric        *prometheus.CounterVec
+	driverReceivedBytesMetric  *prometheus.CounterVec
+	staleConnectionsMetric     *prometheus.CounterVec
+	initFailuresMetric         *prometheus.CounterVec
+	dbVersionInfoMetric        *prometheus.GaugeVec
+	scrapeBudgetExceededMetric *prometheus.CounterVec
+	preparedStatementsMetric   *prometheus.GaugeVec
+	stmtCacheEventsMetric      *prometheus.CounterVec
+	usedPreparedStmtMetric     *prometheus.GaugeVec
+	querySQLInfoMetric         *prometheus.GaugeVec
+	queryInfoMetric            *prometheus.GaugeVec
 )
 
 // Exporter is a prometheus.Gatherer that gathers SQL metrics from targets and merges them with the default registry.
@@ -33,14 +53,19 @@ type Exporter interface {
 	UpdateTarget([]Target)
 	// SetJobFilters sets the jobFilters field
 	SetJobFilters([]string)
-	// DropErrorMetrics resets the scrape_errors_total metric
+	// DropErrorMetrics resets the error metrics: scrape_errors_total, sql_exporter_errors_total,
+	// sql_exporter_driver_errors_total and sql_exporter_column_scan_errors_total
 	DropErrorMetrics()
+	// Close closes the database handles of all targets, waiting for the queries in flight to complete.
+	Close() error
 }
 
 type exporter struct {
 	config     *config.Config
 	targets    []Target
 	jobFilters []string
+	// Limits the rate of query executions across all targets, if configured.
+	rateLimiter *rateLimiter
 
 	ctx context.Context
 }
@@ -62,7 +87,8 @@ func NewExporter(configFile string) (Exporter, error) {
 
 	var targets []Target
 	if c.Target != nil {
-		target, err := NewTarget("", c.Target.Name, "", string(c.Target.DSN), c.Target.Collectors(), nil, c.Globals, c.Target.EnablePing)
+		target, err := NewTarget("", c.Target.Name, "", string(c.Target.DSN), c.Target.Collectors(), nil, c.Globals, c.Target.EnablePing,
+			&c.Target.TargetOptions)
 		if err != nil {
 			return nil, err
 		}
@@ -82,21 +108,57 @@ func NewExporter(configFile string) (Exporter, error) {
 	}
 
 	scrapeErrorsMetric = registerScrapeErrorMetric()
+	errorsByCategoryMetric = registerErrorsByCategoryMetric()
+	driverErrorsMetric = registerDriverErrorsMetric()
+	columnScanErrorsMetric = registerColumnScanErrorMetric()
+	targetConnectedMetric = registerTargetConnectedMetric()
+	connectionEncryptedMetric = registerConnectionEncryptedMetric()
+	driverReceivedBytesMetric = registerDriverReceivedBytesMetric()
+	staleConnectionsMetric = registerStaleConnectionsMetric()
+	initFailuresMetric = registerInitFailuresMetric()
+	dbVersionInfoMetric = registerDBVersionInfoMetric()
+	scrapeBudgetExceededMetric = registerScrapeBudgetExceededMetric()
+	if config.PreparedStatementMetric {
+		usedPreparedStmtMetric = registerUsedPreparedStmtMetric()
+	}
+	if config.QuerySQLHashMetric {
+		querySQLInfoMetric = registerQuerySQLInfoMetric()
+	}
+	if config.QueryInfoMetric {
+		queryInfoMetric = registerQueryInfoMetric()
+	}
+	if config.LastRowTimestampMetric {
+		lastRowTimestampMetric = registerLastRowTimestampMetric()
+	}
+	if config.ConnectionOpenMetric {
+		connectionOpenMetric = registerConnectionOpenMetric()
+	}
+	if config.StatementCacheMetrics {
+		preparedStatementsMetric, stmtCacheEventsMetric = registerStmtCacheMetrics()
+	}
+	if config.ClampedValuesMetric {
+		clampedValuesMetric = registerClampedValuesMetric()
+	}
+	if config.QueryColumnsMetric {
+		queryColumnsMetric = registerQueryColumnsMetric()
+	}
 
 	return &exporter{
-		config:     c,
-		targets:    targets,
-		jobFilters: []string{},
-		ctx:        context.Background(),
+		config:      c,
+		targets:     targets,
+		jobFilters:  []string{},
+		rateLimiter: newRateLimiter(c.Globals.MaxQueriesPerSecond),
+		ctx:         context.Background(),
 	}, nil
 }
 
 func (e *exporter) WithContext(ctx context.Context) Exporter {
 	return &exporter{
-		config:     e.config,
-		targets:    e.targets,
-		jobFilters: e.jobFilters,
-		ctx:        ctx,
+		config:      e.config,
+		targets:     e.targets,
+		jobFilters:  e.jobFilters,
+		rateLimiter: e.rateLimiter,
+		ctx:         ctx,
 	}
 }
 
@@ -119,7 +181,7 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 	for _, t := range e.targets {
 		go func(target Target) {
 			defer wg.Done()
-			target.Collect(e.ctx, metricChan)
+			target.Collect(withRateLimiter(e.ctx, e.rateLimiter), metricChan)
 		}(t)
 	}
 
@@ -141,14 +203,7 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 		dtoMetric := &dto.Metric{}
 		if err := metric.Write(dtoMetric); err != nil {
 			errs = append(errs, err)
-			if err.Context() != "" {
-				ctxLabels := parseContextLog(err.Context())
-				values := make([]string, len(svcMetricLabels))
-				for i, label := range svcMetricLabels {
-					values[i] = ctxLabels[label]
-				}
-				scrapeErrorsMetric.WithLabelValues(values...).Inc()
-			}
+			recordScrapeError(err)
 			continue
 		}
 		metricDesc := metric.Desc()
@@ -212,10 +267,27 @@ func (e *exporter) SetJobFilters(filters []string) {
 	e.jobFilters = filters
 }
 
+// Close implements Exporter.
+func (e *exporter) Close() error {
+	var err error
+	for _, tt := range e.targets {
+		if t, ok := tt.(*target); ok {
+			if cerr := t.close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
 // DropErrorMetrics implements Exporter.
 func (e *exporter) DropErrorMetrics() {
 	scrapeErrorsMetric.Reset()
-	slog.Debug("Dropped scrape_errors_total metric")
+	errorsByCategoryMetric.Reset()
+	driverErrorsMetric.Reset()
+	columnScanErrorsMetric.Reset()
+	slog.Debug("Dropped scrape_errors_total, sql_exporter_errors_total, sql_exporter_driver_errors_total and " +
+		"sql_exporter_column_scan_errors_total metrics")
 }
 
 // registerScrapeErrorMetric registers the metrics for the exporter itself.
@@ -228,6 +300,265 @@ func registerScrapeErrorMetric() *prometheus.CounterVec {
 	return scrapeErrors
 }
 
+// recordScrapeError counts a scrape error in the error metrics.
+func recordScrapeError(err sqlerrors.WithContext) {
+	if err.Context() == "" || scrapeErrorsMetric == nil {
+		return
+	}
+	scrapeErrorsMetric.WithLabelValues(svcMetricLabelValues(err.Context())...).Inc()
+	errorsByCategoryMetric.WithLabelValues(svcMetricLabelValues(err.Context(), string(err.Category()))...).Inc()
+	if reason, sqlState, ok := sqlerrors.DriverReason(err); ok {
+		driverErrorsMetric.WithLabelValues(svcMetricLabelValues(err.Context(), reason, sqlState)...).Inc()
+	}
+}
+
+// dropErrors returns a channel forwarding valid metrics to ch and only recording errors in the error metrics (after
+// passing them to logError) rather than failing the scrape, plus a function to call once no more metrics are to be
+// sent, returning once all of them are forwarded.
+func dropErrors(ch chan<- Metric, logError func(sqlerrors.WithContext)) (chan<- Metric, func()) {
+	filtered := make(chan Metric, capMetricChan)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for metric := range filtered {
+			if metric.Desc() != nil {
+				ch <- metric
+				continue
+			}
+			if err := metric.Write(&dto.Metric{}); err != nil {
+				logError(err)
+				recordScrapeError(err)
+			}
+		}
+	}()
+	return filtered, func() {
+		close(filtered)
+		<-forwarded
+	}
+}
+
+// watchErrors returns a channel forwarding all metrics to ch, calling onError for each error, plus a function to call
+// once no more metrics are to be sent, returning once all of them are forwarded.
+func watchErrors(ch chan<- Metric, onError func()) (chan<- Metric, func()) {
+	watched := make(chan Metric, capMetricChan)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for metric := range watched {
+			if metric.Desc() == nil {
+				onError()
+			}
+			ch <- metric
+		}
+	}()
+	return watched, func() {
+		close(watched)
+		<-forwarded
+	}
+}
+
+// registerErrorsByCategoryMetric registers the metric counting scrape errors by category (e.g. connection, query, scan).
+func registerErrorsByCategoryMetric() *prometheus.CounterVec {
+	errorsByCategory := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_errors_total",
+		Help: "Total number of scrape errors per job, target, collector, query and category",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "category"))
+	SvcRegistry.MustRegister(errorsByCategory)
+	return errorsByCategory
+}
+
+// registerDriverErrorsMetric registers the metric counting scrape errors reported by the database driver, by normalized
+// reason (e.g. auth_failed, too_many_connections) and SQLSTATE.
+func registerDriverErrorsMetric() *prometheus.CounterVec {
+	driverErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_driver_errors_total",
+		Help: "Total number of database driver errors per job, target, collector, query, reason and SQLSTATE (empty if not reported)",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "reason", "sqlstate"))
+	SvcRegistry.MustRegister(driverErrors)
+	return driverErrors
+}
+
+// registerColumnScanErrorMetric registers the metric counting columns that failed to scan in lenient scan mode.
+func registerColumnScanErrorMetric() *prometheus.CounterVec {
+	columnScanErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_column_scan_errors_total",
+		Help: "Total number of column scan errors per job, target, collector, query and column, with lenient scanning",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "column"))
+	SvcRegistry.MustRegister(columnScanErrors)
+	return columnScanErrors
+}
+
+// registerClampedValuesMetric registers the metric counting values limited to their range by clamp transformations.
+func registerClampedValuesMetric() *prometheus.CounterVec {
+	clampedValues := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_clamped_values_total",
+		Help: "Total number of values out of their clamp range per job, target, collector, query and column",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "column"))
+	SvcRegistry.MustRegister(clampedValues)
+	return clampedValues
+}
+
+// registerLastRowTimestampMetric registers the metric tracking when each query last returned at least one row.
+func registerLastRowTimestampMetric() *prometheus.GaugeVec {
+	lastRowTimestamp := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_last_row_timestamp_seconds",
+		Help: "Unix timestamp of the last time a query returned at least one row, per job, target, collector and query",
+	}, svcMetricLabels)
+	SvcRegistry.MustRegister(lastRowTimestamp)
+	return lastRowTimestamp
+}
+
+// registerConnectionOpenMetric registers the metric tracking how long it took to connect to each target.
+func registerConnectionOpenMetric() *prometheus.GaugeVec {
+	connectionOpen := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_connection_open_seconds",
+		Help: "Time it took to open the database handle and complete the first ping, per job and target",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(connectionOpen)
+	return connectionOpen
+}
+
+// registerTargetConnectedMetric registers the metric telling whether each target could be pinged on its last scrape,
+// whatever the outcome of its queries. Targets with ping disabled are not reported, as nothing tells whether they're
+// reachable before their queries run.
+func registerTargetConnectedMetric() *prometheus.GaugeVec {
+	targetConnected := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_target_connected",
+		Help: "1 if the target could be pinged on the last scrape, 0 otherwise, per job and target with ping enabled",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(targetConnected)
+	return targetConnected
+}
+
+// registerConnectionEncryptedMetric registers the metric telling whether the connections of targets requiring
+// encryption are encrypted.
+func registerConnectionEncryptedMetric() *prometheus.GaugeVec {
+	connectionEncrypted := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_connection_encrypted",
+		Help: "1 if the connections are encrypted with TLS, 0 otherwise, for targets requiring encryption, per job and target",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(connectionEncrypted)
+	return connectionEncrypted
+}
+
+// registerDriverReceivedBytesMetric registers the metric counting the bytes received by drivers with compression.
+func registerDriverReceivedBytesMetric() *prometheus.CounterVec {
+	receivedBytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_driver_received_bytes_total",
+		Help: "Bytes received over the wire by drivers with compression enabled, per job and target",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(receivedBytes)
+	return receivedBytes
+}
+
+// registerStaleConnectionsMetric registers the metric counting the pooled connections found broken by validation.
+func registerStaleConnectionsMetric() *prometheus.CounterVec {
+	staleConnections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_stale_connections_total",
+		Help: "Pooled connections found broken before reuse and discarded, for targets validating connections, per job and target",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(staleConnections)
+	return staleConnections
+}
+
+// registerInitFailuresMetric registers the metric counting the new connections failed by an init statement.
+func registerInitFailuresMetric() *prometheus.CounterVec {
+	initFailures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_connection_init_failures_total",
+		Help: "New connections discarded because an init_sql statement failed, per job and target",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(initFailures)
+	return initFailures
+}
+
+// registerDBVersionInfoMetric registers the metric exposing the database server version of each target.
+func registerDBVersionInfoMetric() *prometheus.GaugeVec {
+	dbVersionInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_db_version_info",
+		Help: "Always 1, with the database server version, per job and target",
+	}, []string{"job", "target", "version"})
+	SvcRegistry.MustRegister(dbVersionInfo)
+	return dbVersionInfo
+}
+
+// registerScrapeBudgetExceededMetric registers the metric counting the scrapes aborted for exceeding the target's scrape
+// interval.
+func registerScrapeBudgetExceededMetric() *prometheus.CounterVec {
+	budgetExceeded := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_scrape_budget_exceeded_total",
+		Help: "Scrapes aborted for running longer than the configured scrape interval, per job and target",
+	}, []string{"job", "target"})
+	SvcRegistry.MustRegister(budgetExceeded)
+	return budgetExceeded
+}
+
+// registerStmtCacheMetrics registers the metrics tracking the prepared statement cached by each query, with the hits,
+// misses and evictions of the cache.
+func registerStmtCacheMetrics() (*prometheus.GaugeVec, *prometheus.CounterVec) {
+	preparedStatements := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_prepared_statements",
+		Help: "Number of prepared statements currently cached, per job, target, collector and query",
+	}, svcMetricLabels)
+	stmtCacheEvents := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_prepared_statement_cache_events_total",
+		Help: "Prepared statement cache hits, misses and evictions, per job, target, collector and query",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "event"))
+	SvcRegistry.MustRegister(preparedStatements, stmtCacheEvents)
+	return preparedStatements, stmtCacheEvents
+}
+
+// registerUsedPreparedStmtMetric registers the metric telling whether the last execution of each query used a prepared
+// statement.
+func registerUsedPreparedStmtMetric() *prometheus.GaugeVec {
+	usedPreparedStmt := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_query_used_prepared_statement",
+		Help: "Whether the last execution of a query used a prepared statement (1) or not (0), per job, target, collector and query",
+	}, svcMetricLabels)
+	SvcRegistry.MustRegister(usedPreparedStmt)
+	return usedPreparedStmt
+}
+
+// registerQueryColumnsMetric registers the metric exposing the number of columns expected and returned by each query,
+// telling schema drift apart from other scrape failures.
+func registerQueryColumnsMetric() *prometheus.GaugeVec {
+	queryColumns := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_query_columns",
+		Help: "Number of columns expected by the metrics of the query and returned by its last run, per job, target, collector and query",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "kind"))
+	SvcRegistry.MustRegister(queryColumns)
+	return queryColumns
+}
+
+// registerQuerySQLInfoMetric registers the metric exposing the hash of the SQL text of each query.
+func registerQuerySQLInfoMetric() *prometheus.GaugeVec {
+	querySQLInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_query_sql_info",
+		Help: "Always 1, with the hash of the SQL text of the query, per job, target, collector and query",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "sql_hash"))
+	SvcRegistry.MustRegister(querySQLInfo)
+	return querySQLInfo
+}
+
+// registerQueryInfoMetric registers the metric summarizing the last run of each query, one series per field.
+func registerQueryInfoMetric() *prometheus.GaugeVec {
+	queryInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_query_info",
+		Help: "Duration in seconds, rows processed, rows filtered out and success (1 or 0) of the last run of a query, per job, target, collector, query and field",
+	}, append(svcMetricLabels[:len(svcMetricLabels):len(svcMetricLabels)], "field"))
+	SvcRegistry.MustRegister(queryInfo)
+	return queryInfo
+}
+
+// svcMetricLabelValues returns the values of svcMetricLabels found in the provided log context, followed by extra.
+func svcMetricLabelValues(logContext string, extra ...string) []string {
+	ctxLabels := parseContextLog(logContext)
+	values := make([]string, 0, len(svcMetricLabels)+len(extra))
+	for _, label := range svcMetricLabels {
+		values = append(values, ctxLabels[label])
+	}
+	return append(values, extra...)
+}
+
 // split comma separated list of key=value pairs and return a map of key value pairs
 func parseContextLog(list string) map[string]string {
 	m := make(map[string]string)
@@ -0,0 +1,118 @@
+package sql_exporter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// collectJSON emits the numeric fields of a JSON document column, labeled with their paths.
+func (mf MetricFamily) collectJSON(row map[string]any, labelValues []string, ch chan<- Metric) {
+	j := mf.config.JSON
+	doc := row[j.Column].(sql.NullString)
+	if !doc.Valid {
+		return
+	}
+	tooDeep, err := walkJSON(doc.String, j.Separator, j.MaxDepth, func(path string, value float64) {
+		if len(j.Include) > 0 && !slices.Contains(j.Include, path) {
+			return
+		}
+		labelValues[len(labelValues)-1] = path
+		if mf.config.SanitizeLabels {
+			labelValues[len(labelValues)-1] = sanitizeLabelValue(path)
+		}
+		ch <- NewMetric(&mf, value, labelValues...)
+	})
+	if err != nil {
+		slog.Debug("Skipping invalid JSON document", "logContext", mf.logContext, "column", j.Column, "error", err)
+		return
+	}
+	if tooDeep > 0 {
+		slog.Debug("Skipped JSON fields nested too deep", "logContext", mf.logContext, "column", j.Column,
+			"count", tooDeep, "max_depth", j.MaxDepth)
+	}
+}
+
+// jsonContainer is an object or array being walked by walkJSON.
+type jsonContainer struct {
+	path    string // path of the container itself, empty for the document
+	array   bool
+	index   int    // index of the next array element
+	key     string // key of the next object member
+	haveKey bool   // whether key was read and its value is next
+}
+
+// walkJSON calls fn with the path and value of every number and boolean (as 1 or 0) in a JSON document, in document
+// order, and returns the number of those skipped for being nested deeper than maxDepth. The document is streamed
+// token by token, so deeply nested documents don't cost any recursion, and the values of a document that turns out to
+// be invalid may have been passed to fn already.
+func walkJSON(doc, separator string, maxDepth int, fn func(path string, value float64)) (tooDeep int, err error) {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var stack []*jsonContainer
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return tooDeep, nil
+		}
+		if err != nil {
+			return tooDeep, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		// Work out the path of the value, object keys being tokens of their own.
+		var path string
+		if n := len(stack); n > 0 {
+			c := stack[n-1]
+			switch {
+			case c.array:
+				path = joinJSONPath(c.path, strconv.Itoa(c.index), separator)
+				c.index++
+			case !c.haveKey:
+				c.key, c.haveKey = tok.(string), true
+				continue
+			default:
+				path = joinJSONPath(c.path, c.key, separator)
+				c.haveKey = false
+			}
+		}
+
+		var value float64
+		switch v := tok.(type) {
+		case json.Delim:
+			stack = append(stack, &jsonContainer{path: path, array: v == '['})
+			continue
+		case json.Number:
+			if value, err = v.Float64(); err != nil {
+				continue
+			}
+		case bool:
+			value = boolToFloat64(v)
+		default:
+			continue
+		}
+		switch {
+		case len(stack) == 0:
+			// A bare number or boolean document has no path to label it with.
+		case len(stack) > maxDepth:
+			tooDeep++
+		default:
+			fn(path, value)
+		}
+	}
+}
+
+// joinJSONPath appends an element to a JSON field path.
+func joinJSONPath(path, elem, separator string) string {
+	if path == "" {
+		return elem
+	}
+	return path + separator + elem
+}
@@ -0,0 +1,29 @@
+package sql_exporter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWalkJSON(t *testing.T) {
+	doc := `{"pool": {"active": 3, "idle": 1.5, "name": "main"}, "replicas": [{"lag": 2}, {"lag": null}],
+		"ok": true, "deep": {"a": {"b": {"c": 1}}}}`
+	got := map[string]float64{}
+	tooDeep, err := walkJSON(doc, ".", 3, func(path string, value float64) {
+		got[path] = value
+	})
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	want := map[string]float64{"pool.active": 3, "pool.idle": 1.5, "replicas.0.lag": 2, "ok": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v but got: %v", want, got)
+	}
+	if tooDeep != 1 {
+		t.Fatalf("expected 1 field nested too deep but got: %d", tooDeep)
+	}
+
+	if _, err := walkJSON(`{"a": [1, }`, ".", 2, func(string, float64) {}); err == nil {
+		t.Fatal("expected an error for an invalid document")
+	}
+}
@@ -3,8 +3,14 @@ package sql_exporter
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/burningalchemist/sql_exporter/config"
 	"github.com/burningalchemist/sql_exporter/errors"
@@ -13,6 +19,9 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// truncatedMarker ends label values truncated to the maximum label length.
+const truncatedMarker = "…"
+
 // MetricDesc is a descriptor for a family of metrics, sharing the same name, help, labes, type.
 type MetricDesc interface {
 	Name() string
@@ -30,16 +39,20 @@ type MetricDesc interface {
 // MetricFamily implements MetricDesc for SQL metrics, with logic for populating its labels and values from sql.Rows.
 type MetricFamily struct {
 	config      *config.MetricConfig
+	name        string // metric name, prefixed with the namespace
 	constLabels []*dto.LabelPair
 	labels      []string
 	logContext  string
+	help        string // help text read from the help column, if any
+	// unknownDesc describes the companion metric emitted in place of NULL values, if any.
+	unknownDesc MetricDesc
 }
 
 // NewMetricFamily creates a new MetricFamily with the given metric config and const labels (e.g. job and instance).
 func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair) (*MetricFamily, errors.WithContext) {
 	logContext = TrimMissingCtx(fmt.Sprintf(`%s,metric=%s`, logContext, mc.Name))
 
-	if len(mc.Values) == 0 && mc.StaticValue == nil {
+	if len(mc.Values) == 0 && mc.StaticValue == nil && mc.Flatten == nil && mc.JSON == nil && mc.Distinct == nil {
 		return nil, errors.New(logContext, "no value column defined")
 	}
 	if len(mc.Values) > 1 && mc.ValueLabel == "" {
@@ -51,12 +64,35 @@ func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*
 
 	labels := make([]string, 0, len(mc.KeyLabels)+1)
 	labels = append(labels, mc.KeyLabels...)
+	// The schema label, if any, follows the key labels.
+	if qc := mc.Query(); qc != nil && qc.Schemas != nil {
+		label := qc.Schemas.Label
+		if slices.Contains(mc.KeyLabels, label) || label == mc.ValueLabel || (mc.Flatten != nil && mc.Flatten.Label == label) ||
+			(mc.JSON != nil && mc.JSON.Label == label) {
+			return nil, errors.Errorf(logContext, "schemas label %q is also a label of the metric", label)
+		}
+		labels = append(labels, qc.Schemas.Label)
+	}
 	if mc.ValueLabel != "" {
 		labels = append(labels, mc.ValueLabel)
 	}
+	if mc.Flatten != nil {
+		labels = append(labels, mc.Flatten.Label)
+	}
+	if mc.JSON != nil {
+		labels = append(labels, mc.JSON.Label)
+	}
 
-	// Create a copy of original slice to avoid modifying constLabels
-	sortedLabels := append(constLabels[:0:0], constLabels...)
+	// Create a copy of original slice to avoid modifying constLabels, static labels overriding the target's own labels
+	// (but not job, target and instance).
+	sortedLabels := make([]*dto.LabelPair, 0, len(constLabels)+len(mc.StaticLabels))
+	for _, lp := range constLabels {
+		name := lp.GetName()
+		if _, found := mc.StaticLabels[name]; !found || name == "job" || name == config.TargetLabel ||
+			(config.InstanceLabel != "" && name == config.InstanceLabel) {
+			sortedLabels = append(sortedLabels, lp)
+		}
+	}
 
 	for k, v := range mc.StaticLabels {
 		sortedLabels = append(sortedLabels, &dto.LabelPair{
@@ -64,35 +100,115 @@ func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*
 			Value: proto.String(v),
 		})
 	}
+	// Make it explicit that the metric is populated from a sample of the result set.
+	if qc := mc.Query(); qc != nil && qc.SampleRate > 0 && qc.SampleRate < 1 {
+		sortedLabels = append(sortedLabels, &dto.LabelPair{
+			Name:  proto.String(config.SampleLabel),
+			Value: proto.String(strconv.FormatFloat(qc.SampleRate, 'f', -1, 64)),
+		})
+	}
 	sort.Sort(labelPairSorter(sortedLabels))
 
+	var unknownDesc MetricDesc
+	if mc.UnknownMetric != "" {
+		unknownDesc = NewAutomaticMetricDesc(logContext, mc.PrefixedName(mc.UnknownMetric),
+			fmt.Sprintf("1 for the series of %s whose value is unknown (NULL).", mc.PrefixedName(mc.Name)), prometheus.GaugeValue, sortedLabels,
+			labels...)
+	}
+
 	return &MetricFamily{
 		config:      mc,
+		name:        mc.PrefixedName(mc.Name),
 		constLabels: sortedLabels,
 		labels:      labels,
 		logContext:  logContext,
+		unknownDesc: unknownDesc,
 	}, nil
 }
 
 // Collect is the equivalent of prometheus.Collector.Collect() but takes a Query output map to populate values from.
 func (mf MetricFamily) Collect(row map[string]any, ch chan<- Metric) {
+	if mf.config.HelpColumn != "" {
+		if help, _ := row[mf.config.HelpColumn].(sql.NullString); help.Valid {
+			mf.help = help.String
+		}
+	}
+	if mf.config.SkipNullRows && mf.allValuesNull(row) {
+		return
+	}
 	labelValues := make([]string, len(mf.labels))
 	for i, label := range mf.config.KeyLabels {
 		labelValues[i] = row[label].(sql.NullString).String
 	}
+	for _, mk := range mf.config.Masks {
+		if i := slices.Index(mf.config.KeyLabels, mk.Column); i >= 0 {
+			labelValues[i] = mk.Regexp().ReplaceAllString(labelValues[i], mk.Replacement)
+		}
+	}
+	if qc := mf.config.Query(); qc != nil && qc.Schemas != nil {
+		schema, _ := row[qc.Schemas.Label].(sql.NullString)
+		labelValues[len(mf.config.KeyLabels)] = schema.String
+	}
+	if mf.config.SanitizeLabels {
+		sanitized := 0
+		for i, v := range labelValues[:len(mf.config.KeyLabels)] {
+			if clean := sanitizeLabelValue(v); clean != v {
+				labelValues[i] = clean
+				sanitized++
+			}
+		}
+		if sanitized > 0 {
+			slog.Debug("Sanitized label values", "logContext", mf.logContext, "count", sanitized)
+		}
+	}
+	if limit := mf.maxLabelLength(); limit > 0 {
+		truncated := 0
+		for i, v := range labelValues[:len(mf.config.KeyLabels)] {
+			if utf8.RuneCountInString(v) > limit {
+				labelValues[i] = truncateLabelValue(v, limit)
+				truncated++
+			}
+		}
+		if truncated > 0 {
+			slog.Debug("Truncated label values", "logContext", mf.logContext, "count", truncated, "max_label_length", limit)
+		}
+	}
+	if mf.config.Flatten != nil {
+		mf.collectFlattened(row, labelValues, ch)
+		return
+	}
+	if mf.config.JSON != nil {
+		mf.collectJSON(row, labelValues, ch)
+		return
+	}
+	if d := mf.config.Distinct; d != nil {
+		// The column holds the number of distinct values by now, see distinctCounter.
+		if count, ok := row[d.Column].(sql.NullFloat64); ok {
+			ch <- NewMetric(&mf, count.Float64, labelValues...)
+		}
+		return
+	}
 	for _, v := range mf.config.Values {
 		if mf.config.ValueLabel != "" {
 			labelValues[len(labelValues)-1] = v
 		}
 		value := row[v].(sql.NullFloat64)
+		if !value.Valid && mf.unknownDesc != nil {
+			ch <- NewMetric(mf.unknownDesc, 1, labelValues...)
+		}
 		if value.Valid {
 			metric := NewMetric(&mf, value.Float64, labelValues...)
 			if mf.config.TimestampValue == "" {
 				ch <- metric
 			} else {
 				ts := row[mf.config.TimestampValue].(sql.NullTime)
-				if ts.Valid {
+				switch {
+				case ts.Valid:
 					ch <- NewMetricWithTimestamp(ts.Time, metric)
+				case mf.config.InvalidTimestamp == config.InvalidTimestampNow:
+					ch <- NewMetricWithTimestamp(time.Now(), metric)
+				case mf.config.InvalidTimestamp == config.InvalidTimestampOmit:
+					ch <- metric
 				}
 			}
 		}
@@ -103,13 +219,85 @@ func (mf MetricFamily) Collect(row map[string]any, ch chan<- Metric) {
 	}
 }
 
+// allValuesNull returns whether all the value columns of a row are NULL, i.e. there's no data for its key.
+func (mf MetricFamily) allValuesNull(row map[string]any) bool {
+	for _, v := range mf.config.Values {
+		if row[v].(sql.NullFloat64).Valid {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLabelValue replaces invalid UTF-8 sequences with the Unicode replacement character and strips control
+// characters, either of which would have Prometheus reject the whole scrape.
+func sanitizeLabelValue(v string) string {
+	if utf8.ValidString(v) && strings.IndexFunc(v, unicode.IsControl) < 0 {
+		return v
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(v, string(utf8.RuneError)))
+}
+
+// maxLabelLength returns the maximum length of key label values, from the query or else the global setting.
+func (mf MetricFamily) maxLabelLength() int {
+	if qc := mf.config.Query(); qc != nil && qc.MaxLabelLength > 0 {
+		return qc.MaxLabelLength
+	}
+	return config.MaxLabelLength
+}
+
+// truncateLabelValue cuts a label value down to limit characters, the last one being an ellipsis marking the value
+// as truncated.
+func truncateLabelValue(v string, limit int) string {
+	runes := 0
+	for i := range v {
+		if runes == limit-1 {
+			return v[:i] + truncatedMarker
+		}
+		runes++
+	}
+	return v
+}
+
+// collectFlattened emits the value of a name/value row, labeled with its name.
+func (mf MetricFamily) collectFlattened(row map[string]any, labelValues []string, ch chan<- Metric) {
+	f := mf.config.Flatten
+	name := row[f.NameColumn].(sql.NullString)
+	if !name.Valid || (len(f.Include) > 0 && !slices.Contains(f.Include, name.String)) {
+		return
+	}
+	rawValue := row[f.ValueColumn].(sql.NullString)
+	if !rawValue.Valid {
+		return
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(rawValue.String), 64)
+	if err != nil {
+		slog.Debug("Skipping non-numeric flattened value", "logContext", mf.logContext, "name", name.String,
+			"value", rawValue.String)
+		return
+	}
+	labelValues[len(labelValues)-1] = name.String
+	if mf.config.SanitizeLabels {
+		labelValues[len(labelValues)-1] = sanitizeLabelValue(name.String)
+	}
+	ch <- NewMetric(&mf, value, labelValues...)
+}
+
 // Name implements MetricDesc.
 func (mf MetricFamily) Name() string {
-	return mf.config.Name
+	return mf.name
 }
 
 // Help implements MetricDesc.
 func (mf MetricFamily) Help() string {
+	if mf.help != "" {
+		return mf.help
+	}
 	return mf.config.Help
 }
 
@@ -241,6 +429,8 @@ func (m *constMetric) Write(out *dto.Metric) errors.WithContext {
 	return nil
 }
 
+// makeLabelPairs returns the label pairs of a metric sorted by name, so the output is the same on every scrape
+// regardless of the order key labels are configured (or columns returned) in.
 func makeLabelPairs(desc MetricDesc, labelValues []string) []*dto.LabelPair {
 	labels := desc.Labels()
 	constLabels := desc.ConstLabels()
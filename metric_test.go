@@ -0,0 +1,144 @@
+package sql_exporter
+
+import (
+	"database/sql"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/burningalchemist/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMetricFamilyLabelOrder(t *testing.T) {
+	var mc config.MetricConfig
+	err := yaml.Unmarshal([]byte(`
+metric_name: test
+type: gauge
+help: Test metric.
+key_labels: [zone, app, db]
+value_label: kind
+values: [b, a]
+static_labels: {env: prod}
+query: SELECT 1
+`), &mc)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	constLabels := []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("j")}}
+	mf, werr := NewMetricFamily("", &mc, constLabels)
+	if werr != nil {
+		t.Fatalf("expected no error but got: %v", werr)
+	}
+
+	row := map[string]any{
+		"zone": sql.NullString{String: "z", Valid: true},
+		"app":  sql.NullString{String: "x", Valid: true},
+		"db":   sql.NullString{String: "d", Valid: true},
+		"a":    sql.NullFloat64{Float64: 1, Valid: true},
+		"b":    sql.NullFloat64{Float64: 2, Valid: true},
+	}
+	collect := func() [][]string {
+		ch := make(chan Metric, 10)
+		mf.Collect(row, ch)
+		close(ch)
+		var names [][]string
+		for m := range ch {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			var labels []string
+			for _, lp := range pb.Label {
+				labels = append(labels, lp.GetName())
+			}
+			names = append(names, labels)
+		}
+		return names
+	}
+
+	first := collect()
+	for _, labels := range first {
+		if !slices.IsSorted(labels) {
+			t.Fatalf("expected sorted labels but got: %v", labels)
+		}
+	}
+	for range 5 {
+		if again := collect(); !reflect.DeepEqual(first, again) {
+			t.Fatalf("expected the same labels on every collection, got %v then %v", first, again)
+		}
+	}
+}
+
+func TestMetricFamilyStaticLabelPrecedence(t *testing.T) {
+	var mc config.MetricConfig
+	err := yaml.Unmarshal([]byte(`
+metric_name: test
+type: gauge
+help: Test metric.
+values: [a]
+static_labels: {env: staging}
+query: SELECT 1
+`), &mc)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	constLabels := []*dto.LabelPair{
+		{Name: proto.String("env"), Value: proto.String("prod")},
+		{Name: proto.String("job"), Value: proto.String("j")},
+	}
+	mf, werr := NewMetricFamily("", &mc, constLabels)
+	if werr != nil {
+		t.Fatalf("expected no error but got: %v", werr)
+	}
+
+	ch := make(chan Metric, 1)
+	mf.Collect(map[string]any{"a": sql.NullFloat64{Float64: 1, Valid: true}}, ch)
+	var pb dto.Metric
+	if err := (<-ch).Write(&pb); err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	got := map[string]string{}
+	for _, lp := range pb.Label {
+		got[lp.GetName()] = lp.GetValue()
+	}
+	if want := map[string]string{"env": "staging", "job": "j"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected labels %v but got: %v", want, got)
+	}
+}
+
+func TestMetricFamilyMasks(t *testing.T) {
+	var mc config.MetricConfig
+	err := yaml.Unmarshal([]byte(`
+metric_name: test
+type: gauge
+help: Test metric.
+key_labels: [owner]
+values: [a]
+masks:
+  - {column: owner, pattern: '^[^@]+'}
+query: SELECT 1
+`), &mc)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	mf, werr := NewMetricFamily("", &mc, nil)
+	if werr != nil {
+		t.Fatalf("expected no error but got: %v", werr)
+	}
+
+	ch := make(chan Metric, 1)
+	mf.Collect(map[string]any{
+		"owner": sql.NullString{String: "jane.doe@example.com", Valid: true},
+		"a":     sql.NullFloat64{Float64: 1, Valid: true},
+	}, ch)
+	var pb dto.Metric
+	if err := (<-ch).Write(&pb); err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	if got := pb.Label[0].GetValue(); got != "***@example.com" {
+		t.Fatalf("expected masked label value but got: %q", got)
+	}
+}
@@ -2,11 +2,24 @@ package sql_exporter
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/burningalchemist/sql_exporter/config"
 	"github.com/burningalchemist/sql_exporter/errors"
@@ -18,10 +31,34 @@ type Query struct {
 	metricFamilies []*MetricFamily
 	// columnTypes maps column names to the column type expected by metrics: key (string) or value (float64).
 	columnTypes columnTypeMap
-	logContext  string
+	// foldedColumns maps lower-cased column names to configured ones, with case insensitive column matching only.
+	foldedColumns map[string]string
+	// emptyAsNull holds the key columns where empty strings are handled as NULL.
+	emptyAsNull map[string]bool
+	// keyDefaults holds the label values of key columns tolerated as missing from the results.
+	keyDefaults map[string]string
+	// timeLayouts holds the layouts of time columns returned as strings.
+	timeLayouts map[string]timeLayout
+	// intervalColumns holds the value columns returned as interval strings, parsed into seconds.
+	intervalColumns map[string]bool
+	logContext      string
+	// logger honors the log level of the query, if configured.
+	logger *slog.Logger
+	// deltas holds the previous values of delta transformations, nil if none are configured.
+	deltas *deltaTracker
+	// lastScrape is the scrape time of the previous run, resolving the interval_start time parameter. lastScrapeMu
+	// protects it from concurrent scrapes.
+	lastScrapeMu sync.Mutex
+	lastScrape   time.Time
+	// resultSets maps the position of further result sets returned by the query to the Query populating their metrics.
+	resultSets map[int]*Query
+	// sqlHash identifies the SQL text of the query, for detecting configuration drift.
+	sqlHash string
 
-	conn *sql.DB
-	stmt *sql.Stmt
+	// stmtMu protects the database handle and the statement prepared on it, from concurrent runs.
+	stmtMu sync.Mutex
+	conn   *sql.DB
+	stmt   *sql.Stmt
 }
 
 type (
@@ -33,12 +70,59 @@ const (
 	columnTypeKey   columnType = 1
 	columnTypeValue columnType = 2
 	columnTypeTime  columnType = 3
+	// Binary columns are only scanned into their digest, see binaryDigest.
+	columnTypeBinary columnType = 4
 )
 
 // NewQuery returns a new Query that will populate the given metric families.
-func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*MetricFamily) (*Query, errors.WithContext) {
+func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*MetricFamily) (_ *Query, werr errors.WithContext) {
+	defer func() { werr = errors.Categorize(werr, errors.CategoryConfig) }()
 	logContext = TrimMissingCtx(fmt.Sprintf(`%s,query=%s`, logContext, qc.Name))
 
+	// Group metric families by the (0-based) position of the result set they are populated from. Each result set has
+	// its own columns, so they are mapped by a separate Query, which never runs the SQL itself.
+	bySet := make(map[int][]*MetricFamily, 1)
+	for _, mf := range metricFamilies {
+		bySet[mf.config.ResultSet] = append(bySet[mf.config.ResultSet], mf)
+	}
+
+	if qc.Schemas != nil && !strings.Contains(qc.Query, config.SchemaPlaceholder) {
+		return nil, errors.Errorf(logContext, "query with schemas does not contain the %s placeholder", config.SchemaPlaceholder)
+	}
+
+	q, err := newQuery(logContext, qc, bySet[0]...)
+	if err != nil {
+		return nil, err
+	}
+	for i, mfs := range bySet {
+		if i == 0 {
+			continue
+		}
+		rs, err := newQuery(logContext, qc, mfs...)
+		if err != nil {
+			return nil, err
+		}
+		if q.resultSets == nil {
+			q.resultSets = make(map[int]*Query, len(bySet)-1)
+		}
+		q.resultSets[i] = rs
+	}
+
+	// Delta state is tracked for the whole query execution, whichever result set the metrics come from.
+	for _, mf := range metricFamilies {
+		if len(mf.config.Deltas) > 0 {
+			q.deltas = newDeltaTracker()
+			for _, rs := range q.resultSets {
+				rs.deltas = q.deltas
+			}
+			break
+		}
+	}
+	return q, nil
+}
+
+// newQuery returns a new Query that will populate the given metric families from a single result set.
+func newQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*MetricFamily) (*Query, errors.WithContext) {
 	columnTypes := make(columnTypeMap)
 
 	for _, mf := range metricFamilies {
@@ -53,14 +137,142 @@ func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*Metr
 			}
 		}
 
+		for _, pv := range mf.config.ParsedValues {
+			transformedColumns[pv.OutputColumn] = true
+			// The source column is scanned as a string and parsed into a float during transformations
+			if err := setColumnType(logContext, pv.SourceColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, c := range mf.config.Coalesces {
+			transformedColumns[c.OutputColumn] = true
+			for _, col := range c.SourceColumns {
+				if err := setColumnType(logContext, col, columnTypeValue, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, p := range mf.config.Percents {
+			transformedColumns[p.OutputColumn] = true
+			for _, col := range []string{p.PartColumn, p.WholeColumn} {
+				if err := setColumnType(logContext, col, columnTypeValue, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, d := range mf.config.Deltas {
+			transformedColumns[d.OutputColumn] = true
+			if err := setColumnType(logContext, d.SourceColumn, columnTypeValue, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, e := range mf.config.Elapsed {
+			transformedColumns[e.OutputColumn] = true
+			// Timestamps are scanned as strings, like for lag calculations
+			for _, col := range []string{e.StartColumn, e.EndColumn} {
+				if err := setColumnType(logContext, col, columnTypeKey, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, d := range mf.config.Durations {
+			transformedColumns[d.OutputColumn] = true
+			// The source column is scanned as a string and parsed into seconds during transformations
+			if err := setColumnType(logContext, d.SourceColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, c := range mf.config.Checksums {
+			transformedColumns[c.OutputColumn] = true
+			if err := setColumnType(logContext, c.SourceColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, d := range mf.config.BinaryDigests {
+			transformedColumns[d.OutputColumn] = true
+			if err := setColumnType(logContext, d.SourceColumn, columnTypeBinary, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, s := range mf.config.Splits {
+			for _, col := range s.Keys {
+				transformedColumns[col] = true
+			}
+			if err := setColumnType(logContext, s.SourceColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, c := range mf.config.Composites {
+			for _, col := range c.Fields {
+				if col != "" {
+					transformedColumns[col] = true
+				}
+			}
+			if err := setColumnType(logContext, c.SourceColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, b := range mf.config.Buckets {
+			transformedColumns[b.OutputColumn] = true
+			if err := setColumnType(logContext, b.SourceColumn, columnTypeValue, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		if f := mf.config.Flatten; f != nil {
+			// Values are scanned as strings, since name/value tables usually hold values of mixed types
+			for _, col := range []string{f.NameColumn, f.ValueColumn} {
+				if err := setColumnType(logContext, col, columnTypeKey, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if j := mf.config.JSON; j != nil {
+			if err := setColumnType(logContext, j.Column, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		if d := mf.config.Distinct; d != nil {
+			if err := setColumnType(logContext, d.Column, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
+		if mf.config.HelpColumn != "" {
+			if err := setColumnType(logContext, mf.config.HelpColumn, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+
 		// Add columns used in row filters
 		for _, filter := range mf.config.RowFilters {
 			if err := setColumnType(logContext, filter.Column, columnTypeKey, columnTypes); err != nil {
 				return nil, err
 			}
+			if filter.CompareColumn != "" {
+				if err := setColumnType(logContext, filter.CompareColumn, columnTypeKey, columnTypes); err != nil {
+					return nil, err
+				}
+			}
 		}
 
 		for _, kcol := range mf.config.KeyLabels {
+			// Skip key columns that are created by transformations
+			if transformedColumns[kcol] {
+				continue
+			}
 			if err := setColumnType(logContext, kcol, columnTypeKey, columnTypes); err != nil {
 				return nil, err
 			}
@@ -85,18 +297,104 @@ func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*Metr
 		metricFamilies: metricFamilies,
 		columnTypes:    columnTypes,
 		logContext:     logContext,
+		logger:         slog.Default(),
+		sqlHash:        sqlHash(qc.Query),
+	}
+	if qc.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(qc.LogLevel)); err != nil {
+			return nil, errors.Wrap(logContext, err)
+		}
+		q.logger = slog.New(&levelHandler{Handler: q.logger.Handler(), level: level})
+	}
+	if qc.CaseInsensitive {
+		q.foldedColumns = make(map[string]string, len(columnTypes))
+		for col := range columnTypes {
+			folded := strings.ToLower(col)
+			if other, found := q.foldedColumns[folded]; found {
+				return nil, errors.Errorf(logContext, "columns %q and %q are ambiguous with case insensitive matching", other, col)
+			}
+			q.foldedColumns[folded] = col
+		}
+	}
+	if len(qc.EmptyAsNull) > 0 {
+		q.emptyAsNull = make(map[string]bool, len(qc.EmptyAsNull))
+		for _, col := range qc.EmptyAsNull {
+			if columnTypes[col] != columnTypeKey {
+				return nil, errors.Errorf(logContext, "empty_as_null column %q is not a key column", col)
+			}
+			q.emptyAsNull[col] = true
+		}
+	}
+	for _, mf := range metricFamilies {
+		for col, def := range mf.config.KeyDefaults {
+			if columnTypes[col] != columnTypeKey {
+				return nil, errors.Errorf(logContext, "key_defaults column %q is not a key column", col)
+			}
+			if other, found := q.keyDefaults[col]; found && other != def {
+				return nil, errors.Errorf(logContext, "conflicting key_defaults %q and %q for column %q", other, def, col)
+			}
+			if q.keyDefaults == nil {
+				q.keyDefaults = make(map[string]string)
+			}
+			q.keyDefaults[col] = def
+		}
+		if mf.config.TimestampLayout != "" {
+			col := mf.config.TimestampValue
+			layout := timeLayout{config.TimestampLayout(mf.config.TimestampLayout), mf.config.TimestampLocation()}
+			if other, found := q.timeLayouts[col]; found && other != layout {
+				return nil, errors.Errorf(logContext, "conflicting timestamp_layout %q (%s) and %q (%s) for column %q",
+					other.layout, other.loc, layout.layout, layout.loc, col)
+			}
+			if q.timeLayouts == nil {
+				q.timeLayouts = make(map[string]timeLayout)
+			}
+			q.timeLayouts[col] = layout
+		}
+		for _, col := range mf.config.IntervalValues {
+			if q.intervalColumns == nil {
+				q.intervalColumns = make(map[string]bool)
+			}
+			q.intervalColumns[col] = true
+		}
 	}
-
 	// Debug logging to see what columns we're expecting
 	expectedColumns := make([]string, 0, len(columnTypes))
 	for col := range columnTypes {
 		expectedColumns = append(expectedColumns, col)
 	}
-	slog.Debug("Expected columns from SQL", "logContext", logContext, "columns", expectedColumns)
+	q.logger.Debug("Expected columns from SQL", "logContext", logContext, "columns", expectedColumns)
 
 	return &q, nil
 }
 
+// sqlHash returns a short SHA-256 hash of a query's SQL text, allowing to tell versions apart without exposing it.
+func sqlHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:8])
+}
+
+// levelHandler is a slog.Handler overriding the level of the wrapped handler, lower or higher.
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+// Enabled implements slog.Handler.
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+// WithAttrs implements slog.Handler.
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+// WithGroup implements slog.Handler.
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
 // setColumnType stores the provided type for a given column, checking for conflicts in the process.
 func setColumnType(logContext, columnName string, ctype columnType, columnTypes columnTypeMap) errors.WithContext {
 	previousType, found := columnTypes[columnName]
@@ -110,37 +408,297 @@ func setColumnType(logContext, columnName string, ctype columnType, columnTypes
 	return nil
 }
 
+// resolveColumn returns the configured name and the type of a column returned by the query. The type is zero for
+// columns which aren't used by any metric.
+func (q *Query) resolveColumn(column string) (string, columnType) {
+	if q.foldedColumns != nil {
+		if name, found := q.foldedColumns[strings.ToLower(column)]; found {
+			return name, q.columnTypes[name]
+		}
+		return column, 0
+	}
+	return column, q.columnTypes[column]
+}
+
 // Collect is the equivalent of prometheus.Collector.Collect() but takes a context to run in and a database to run on.
 func (q *Query) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
-	collectStart := time.Now()
-
 	if ctx.Err() != nil {
 		ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
 		return
 	}
 
-	rows, err := q.run(ctx, conn)
+	if querySQLInfoMetric != nil {
+		querySQLInfoMetric.WithLabelValues(svcMetricLabelValues(q.logContext, q.sqlHash)...).Set(1)
+	}
+
+	// Route the query to the named target connection (e.g. a read replica), if any.
+	if name := q.config.Connection; name != "" {
+		if conn = connectionFromContext(ctx, name); conn == nil {
+			ch <- NewInvalidMetric(errors.Errorf(q.logContext, "connection %q is not open", name))
+			return
+		}
+	}
+
+	if q.deltas != nil {
+		q.deltas.begin()
+		var done func()
+		ch, done = watchErrors(ch, q.deltas.fail)
+		defer func() {
+			done()
+			// Forget series which didn't show up in this scrape, so the state doesn't grow unbounded.
+			q.deltas.prune()
+		}()
+	}
+
+	// Time parameters are resolved once per scrape, so all runs of a params_from query share the same window.
+	var timeArgs []any
+	if len(q.config.TimeParams) > 0 {
+		scrapeTime := time.Now()
+		timeArgs = q.timeParamValues(scrapeTime)
+		defer func() {
+			q.lastScrapeMu.Lock()
+			defer q.lastScrapeMu.Unlock()
+			q.lastScrape = scrapeTime
+		}()
+	}
+
+	if q.config.Schemas != nil {
+		q.collectSchemas(ctx, conn, ch, timeArgs)
+		return
+	}
+	if q.config.ParamsFrom == nil {
+		q.collect(ctx, conn, ch, "", timeArgs...)
+		return
+	}
+
+	// Run the query once per value returned by the params_from query.
+	params, err := q.paramValues(ctx, conn)
 	if err != nil {
 		ch <- NewInvalidMetric(err)
 		return
 	}
+	if len(params) == 0 {
+		q.logger.Debug("No parameter values returned, skipping query", "logContext", q.logContext, "params_from", q.config.ParamsFrom.QueryRef)
+		return
+	}
+	for _, param := range params {
+		if ctx.Err() != nil {
+			ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
+			return
+		}
+		q.collect(ctx, conn, ch, "", append([]any{param}, timeArgs...)...)
+	}
+}
+
+// timeParamValues returns the values of the configured time parameters, formatted according to the layout (if any).
+func (q *Query) timeParamValues(scrapeTime time.Time) []any {
+	q.lastScrapeMu.Lock()
+	lastScrape := q.lastScrape
+	q.lastScrapeMu.Unlock()
+
+	values := make([]any, 0, len(q.config.TimeParams))
+	for _, param := range q.config.TimeParams {
+		t := scrapeTime
+		if param == config.TimeParamIntervalStart && !lastScrape.IsZero() {
+			t = lastScrape
+		}
+
+		switch layout := q.config.TimeParamsLayout; layout {
+		case "":
+			values = append(values, t)
+		case config.TimeLayoutUnix:
+			values = append(values, t.Unix())
+		case config.TimeLayoutUnixMilli:
+			values = append(values, t.UnixMilli())
+		default:
+			values = append(values, t.Format(layout))
+		}
+	}
+	q.logger.Debug("Resolved time parameters", "logContext", q.logContext, "params", q.config.TimeParams, "values", values)
+	return values
+}
+
+// paramValues runs the params_from query and returns the non-NULL values of its configured column.
+func (q *Query) paramValues(ctx context.Context, conn *sql.DB) (_ []any, werr errors.WithContext) {
+	defer func() { werr = errors.Categorize(werr, errors.CategoryQuery) }()
+
+	pf := q.config.ParamsFrom
+	if err := q.rateLimit(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, pf.Query().Query)
+	if err != nil {
+		return nil, errors.Wrapf(q.logContext, err, "params_from query %q failed", pf.QueryRef)
+	}
 	defer rows.Close()
 
-	dest, err := q.scanDest(rows)
+	columns, err := rows.Columns()
 	if err != nil {
-		if config.IgnoreMissingVals {
-			slog.Warn("Ignoring missing values", "logContext", q.logContext)
+		return nil, errors.Wrap(q.logContext, err)
+	}
+	index := -1
+	dest := make([]any, len(columns))
+	for i, column := range columns {
+		if column == pf.Column {
+			index = i
+			dest[i] = new(sql.NullString)
+		} else {
+			dest[i] = new(any)
+		}
+	}
+	if index < 0 {
+		return nil, errors.Errorf(q.logContext, "params_from query %q did not return column %q", pf.QueryRef, pf.Column)
+	}
+
+	var params []any
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, errors.Wrapf(q.logContext, err, "scanning of params_from query %q failed", pf.QueryRef)
+		}
+		if v := dest[index].(*sql.NullString); v.Valid {
+			params = append(params, v.String)
+		}
+		if len(params) > pf.MaxFanOut {
+			return nil, errors.Errorf(q.logContext, "params_from query %q returned more than %d values", pf.QueryRef, pf.MaxFanOut)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(q.logContext, err)
+	}
+	return params, nil
+}
+
+// collect runs the query once with the provided arguments (in the provided schema, if any) and populates the metric
+// families from its results.
+func (q *Query) collect(ctx context.Context, conn *sql.DB, ch chan<- Metric, schema string, args ...any) {
+	collectStart := time.Now()
+	var totalRowsProcessed, totalRowsFiltered int
+	succeeded := false
+	if queryInfoMetric != nil {
+		defer func() {
+			q.setQueryInfo(time.Since(collectStart), totalRowsProcessed, totalRowsFiltered, succeeded)
+		}()
+	}
+
+	rows, err := q.run(ctx, conn, schema, args...)
+	// Retry on transient errors (e.g. deadlocks or reset connections) for as long as the scrape context allows, backing
+	// off between attempts.
+	for attempt := 1; err != nil && attempt <= q.config.Retries && ctx.Err() == nil && IsTransientError(err); attempt++ {
+		q.logger.Warn("Retrying query after transient error", "logContext", q.logContext, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
 			return
+		case <-time.After(transientRetryDelay << (attempt - 1)):
 		}
+		rows, err = q.run(ctx, conn, schema, args...)
+	}
+	if err != nil {
 		ch <- NewInvalidMetric(err)
 		return
 	}
+	executed := time.Since(collectStart)
+
+	// Retry queries returning no rows, e.g. transiently empty eventually consistent views. Peek at the first row to tell,
+	// except on the last attempt, which is collected as usual.
+	peeked := false
+	for attempt := 1; attempt <= q.config.RetryOnEmpty; attempt++ {
+		if peeked = rows.Next(); peeked {
+			break
+		}
+		if err := rows.Err(); err != nil {
+			ch <- NewInvalidMetric(errors.Wrap(q.logContext, err))
+			return
+		}
+		rows.Close()
+		q.logger.Debug("Retrying query returning no rows", "logContext", q.logContext, "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
+			return
+		case <-time.After(retryOnEmptyDelay):
+		}
+		if rows, err = q.run(ctx, conn, schema, args...); err != nil {
+			ch <- NewInvalidMetric(err)
+			return
+		}
+	}
+	defer rows.Close()
+
+	totalRowsProcessed, totalRowsFiltered = q.collectRows(rows, ch, schema, collectStart, peeked)
+	// Further result sets (e.g. returned by stored procedures) populate the metric families configured for their position.
+	for i := 1; len(q.resultSets) > 0 && rows.NextResultSet(); i++ {
+		rs, found := q.resultSets[i]
+		if !found {
+			q.logger.Debug("Ignoring result set without metrics", "logContext", q.logContext, "result_set", i)
+			continue
+		}
+		processed, filtered := rs.collectRows(rows, ch, schema, collectStart, false)
+		totalRowsProcessed += processed
+		totalRowsFiltered += filtered
+	}
+
+	if err1 := rows.Err(); err1 != nil {
+		ch <- NewInvalidMetric(errors.Categorize(errors.Wrap(q.logContext, err1), errors.CategoryQuery))
+	} else {
+		succeeded = true
+	}
+
+	if totalRowsProcessed > 0 && lastRowTimestampMetric != nil {
+		lastRowTimestampMetric.WithLabelValues(svcMetricLabelValues(q.logContext)...).SetToCurrentTime()
+	}
+
+	// Only log the details of slow executions, to keep the log quiet otherwise.
+	if threshold := time.Duration(q.config.SlowLogThreshold); threshold > 0 {
+		if duration := time.Since(collectStart); duration > threshold {
+			q.logger.Warn("Slow query execution", "logContext", q.logContext, "duration", duration, "execution", executed,
+				"rows", totalRowsProcessed, "args", len(args), "threshold", threshold)
+		}
+	}
+}
+
+// Delay between retries of queries returning no rows.
+const retryOnEmptyDelay = 200 * time.Millisecond
+
+// Delay before the first retry of queries failing with a transient error, doubled on every further attempt.
+const transientRetryDelay = 50 * time.Millisecond
+
+// collectRows populates the metric families from the current result set of rows and returns the number of rows
+// processed and filtered out. With peeked, rows is already positioned on the first row. With a schema, rows carry its name as the
+// schemas label.
+func (q *Query) collectRows(rows *sql.Rows, ch chan<- Metric, schema string, collectStart time.Time, peeked bool) (int, int) {
+	dest, err := q.scanDest(rows)
+	if err != nil {
+		if q.ignoreMissingVals() {
+			q.logger.Warn("Ignoring missing values", "logContext", q.logContext)
+			return 0, 0
+		}
+		ch <- NewInvalidMetric(err)
+		return 0, 0
+	}
 
 	totalRowsProcessed := 0
 	totalRowsFiltered := 0
+	totalRowsSampledOut := 0
+	totalRowsLimited := 0
 	metricsGenerated := 0
 
-	for rows.Next() {
+	sampler := q.newSampler(collectStart)
+	// Metric families reducing all rows into a single one, populated as rows come in.
+	var reducers map[*MetricFamily]*rowReducer
+	// Metric families counting the distinct values of a column, populated as rows come in.
+	var distincts map[*MetricFamily]*distinctCounter
+	// Help texts read from the first row, for metric families with a help column.
+	var helps map[*MetricFamily]*firstHelp
+	// Rows passing the row filters so far, for metric families with a row limit.
+	var rowCounts map[*MetricFamily]int
+
+	for next := peeked || rows.Next(); next; next = rows.Next() {
+		// Skip rows not selected by the sampler before paying for scanning them
+		if sampler != nil && sampler.Float64() >= q.config.SampleRate {
+			totalRowsSampledOut++
+			continue
+		}
 		totalRowsProcessed++
 
 		row, err := q.scanRow(rows, dest)
@@ -148,6 +706,9 @@ func (q *Query) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
 			ch <- NewInvalidMetric(err)
 			continue
 		}
+		if schema != "" {
+			row[q.config.Schemas.Label] = sql.NullString{String: schema, Valid: true}
+		}
 
 		// Apply row filtering and transformations for each metric family
 		for _, mf := range q.metricFamilies {
@@ -156,100 +717,485 @@ func (q *Query) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
 				totalRowsFiltered++
 				continue
 			}
+			if limit := mf.config.RowLimit; limit > 0 {
+				if rowCounts == nil {
+					rowCounts = make(map[*MetricFamily]int)
+				}
+				if rowCounts[mf] >= limit {
+					totalRowsLimited++
+					continue
+				}
+				rowCounts[mf]++
+			}
 
 			// Apply lag calculations and other transformations
-			transformedRow := q.applyTransformations(row, mf.config)
+			transformedRow := q.applyTransformations(row, schema, mf.config)
+
+			// Prometheus help is per metric, not per series: stick to the help of the first row.
+			if col := mf.config.HelpColumn; col != "" {
+				if helps == nil {
+					helps = make(map[*MetricFamily]*firstHelp)
+				}
+				help, _ := transformedRow[col].(sql.NullString)
+				if first := helps[mf]; first == nil {
+					helps[mf] = &firstHelp{help: help}
+				} else if help != first.help {
+					if !first.warned {
+						q.logger.Warn("Help text varies across rows, using the first one", "logContext", mf.logContext,
+							"column", col, "help", first.help.String, "other", help.String)
+						first.warned = true
+					}
+					transformedRow[col] = first.help
+				}
+			}
+
+			if mf.config.Reduce != "" {
+				if reducers == nil {
+					reducers = make(map[*MetricFamily]*rowReducer)
+				}
+				if reducers[mf] == nil {
+					reducers[mf] = &rowReducer{mode: mf.config.Reduce}
+				}
+				reducers[mf].add(transformedRow, mf.config.Values)
+				continue
+			}
+
+			if d := mf.config.Distinct; d != nil {
+				if distincts == nil {
+					distincts = make(map[*MetricFamily]*distinctCounter)
+				}
+				if distincts[mf] == nil {
+					distincts[mf] = &distinctCounter{column: d.Column, maxValues: d.MaxValues}
+				}
+				distincts[mf].add(transformedRow)
+				continue
+			}
+
+			if len(mf.config.SplitSets) > 0 {
+				for _, r := range splitSets(transformedRow, mf.config.SplitSets) {
+					mf.Collect(r, ch)
+					metricsGenerated++
+				}
+				continue
+			}
 
 			mf.Collect(transformedRow, ch)
 			metricsGenerated++
 		}
 	}
 
-	if err1 := rows.Err(); err1 != nil {
-		ch <- NewInvalidMetric(errors.Wrap(q.logContext, err1))
+	for _, mf := range q.metricFamilies {
+		if r := reducers[mf]; r != nil {
+			mf.Collect(r.result(mf.config.Values), ch)
+			metricsGenerated++
+		}
+		if d := distincts[mf]; d != nil {
+			if d.overflow {
+				q.logger.Warn("Too many distinct values, reporting max_values", "logContext", mf.logContext,
+					"column", d.column, "max_values", d.maxValues)
+			}
+			mf.Collect(d.result(), ch)
+			metricsGenerated++
+		}
 	}
 
 	// Log performance summary
-	slog.Debug("Query collection completed",
+	q.logger.Debug("Query collection completed",
 		"logContext", q.logContext,
 		"duration_ms", time.Since(collectStart).Milliseconds(),
 		"rows_processed", totalRowsProcessed,
 		"rows_filtered", totalRowsFiltered,
+		"rows_sampled_out", totalRowsSampledOut,
+		"rows_limited", totalRowsLimited,
 		"metrics_generated", metricsGenerated,
 	)
+	return totalRowsProcessed, totalRowsFiltered
 }
 
-// run executes the query on the provided database, in the provided context.
-func (q *Query) run(ctx context.Context, conn *sql.DB) (*sql.Rows, errors.WithContext) {
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+// setQueryInfo exports the summary of the last run of the query.
+func (q *Query) setQueryInfo(duration time.Duration, processed, filtered int, succeeded bool) {
+	success := 0.0
+	if succeeded {
+		success = 1
+	}
+	for field, value := range map[string]float64{
+		"duration_seconds": duration.Seconds(),
+		"rows_processed":   float64(processed),
+		"rows_filtered":    float64(filtered),
+		"success":          success,
+	} {
+		queryInfoMetric.WithLabelValues(svcMetricLabelValues(q.logContext, field)...).Set(value)
+	}
+}
+
+// ignoreMissingVals returns whether results missing requested columns are ignored rather than reported as errors, as
+// configured for the query or else by the global flag.
+func (q *Query) ignoreMissingVals() bool {
+	if q.config.IgnoreMissingVals != nil {
+		return *q.config.IgnoreMissingVals
+	}
+	return config.IgnoreMissingVals
+}
+
+// firstHelp is the help text read from the first row of a metric family with a help column.
+type firstHelp struct {
+	help   sql.NullString
+	warned bool // whether a different help text was already reported
+}
+
+// rowReducer reduces the rows of a metric family into a single row, keeping either the first row or the first row with
+// its values replaced by their sum, average, minimum or maximum over all rows. NULL values are left out.
+type rowReducer struct {
+	mode   string
+	row    map[string]any
+	acc    map[string]float64 // sums, or extremes for min and max
+	counts map[string]int
+}
+
+// add accounts for a row.
+func (r *rowReducer) add(row map[string]any, values []string) {
+	if r.row == nil {
+		r.row = row
+		r.acc = make(map[string]float64, len(values))
+		r.counts = make(map[string]int, len(values))
+	}
+	if r.mode == config.ReduceFirst {
+		return
+	}
+	for _, v := range values {
+		value, ok := row[v].(sql.NullFloat64)
+		if !ok || !value.Valid {
+			continue
+		}
+		switch {
+		case r.mode == config.ReduceMin && r.counts[v] > 0:
+			r.acc[v] = min(r.acc[v], value.Float64)
+		case r.mode == config.ReduceMax && r.counts[v] > 0:
+			r.acc[v] = max(r.acc[v], value.Float64)
+		default:
+			r.acc[v] += value.Float64
+		}
+		r.counts[v]++
+	}
+}
+
+// result returns the reduced row.
+func (r *rowReducer) result(values []string) map[string]any {
+	if r.mode == config.ReduceFirst {
+		return r.row
+	}
+	reduced := make(map[string]any, len(r.row))
+	for k, v := range r.row {
+		reduced[k] = v
+	}
+	for _, v := range values {
+		value := sql.NullFloat64{Float64: r.acc[v], Valid: r.counts[v] > 0}
+		if r.mode == config.ReduceAvg && value.Valid {
+			value.Float64 /= float64(r.counts[v])
+		}
+		reduced[v] = value
+	}
+	return reduced
+}
+
+// distinctCounter counts the distinct non-NULL values of a column across the rows of a metric family, tracking up to
+// maxValues of them.
+type distinctCounter struct {
+	column    string
+	maxValues int
+	row       map[string]any
+	values    map[string]struct{}
+	overflow  bool // whether values were left out for exceeding maxValues
+}
+
+// add accounts for a row.
+func (d *distinctCounter) add(row map[string]any) {
+	if d.row == nil {
+		d.row = row
+		d.values = make(map[string]struct{})
+	}
+	value, ok := row[d.column].(sql.NullString)
+	if !ok || !value.Valid {
+		return
+	}
+	if _, found := d.values[value.String]; found {
+		return
+	}
+	if len(d.values) >= d.maxValues {
+		d.overflow = true
+		return
+	}
+	d.values[value.String] = struct{}{}
+}
+
+// result returns the first row, with the column replaced by the number of its distinct values.
+func (d *distinctCounter) result() map[string]any {
+	counted := make(map[string]any, len(d.row))
+	for k, v := range d.row {
+		counted[k] = v
+	}
+	counted[d.column] = sql.NullFloat64{Float64: float64(len(d.values)), Valid: true}
+	return counted
+}
+
+// newSampler returns a random source to sample result rows with, or nil if sampling is disabled. The source is seeded
+// from the query name and the scrape start time (in seconds), so a given scrape samples the same rows when replayed.
+func (q *Query) newSampler(scrapeStart time.Time) *rand.Rand {
+	if q.config.SampleRate <= 0 || q.config.SampleRate >= 1 {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(q.config.Name))
+	seed := uint64(scrapeStart.Unix())
+	q.logger.Debug("Sampling query results", "logContext", q.logContext, "sample_rate", q.config.SampleRate, "seed", seed)
+	return rand.New(rand.NewPCG(seed, h.Sum64()))
+}
+
+// run executes the query on the provided database, in the provided context, with the provided arguments. With a
+// schema, its name replaces the schema placeholder.
+func (q *Query) run(ctx context.Context, conn *sql.DB, schema string, args ...any) (_ *sql.Rows, werr errors.WithContext) {
+	defer func() { werr = errors.Categorize(werr, errors.CategoryQuery) }()
+
+	if q.logger.Enabled(ctx, slog.LevelDebug) {
 		start := time.Now()
 		defer func() {
-			slog.Debug("Query execution time", "logContext", q.logContext, "duration", time.Since(start))
+			q.logger.Debug("Query execution time", "logContext", q.logContext, "duration", time.Since(start))
 		}()
 	}
 
-	if q.conn != nil && q.conn != conn {
-		panic(fmt.Sprintf("[%s] Expecting to always run on the same database handle", q.logContext))
+	if err := q.rateLimit(ctx); err != nil {
+		return nil, err
 	}
 
+	if schema != "" {
+		// The SQL differs from one schema to the next, so it isn't worth preparing.
+		q.recordPreparedStatementUse(false)
+		rows, err := conn.QueryContext(ctx, strings.ReplaceAll(q.config.Query, config.SchemaPlaceholder, schema), args...)
+		return rows, errors.Wrap(q.logContext, err)
+	}
 	if q.config.NoPreparedStatement {
-		rows, err := conn.QueryContext(ctx, q.config.Query)
+		q.recordPreparedStatementUse(false)
+		rows, err := conn.QueryContext(ctx, q.config.Query, args...)
 		return rows, errors.Wrap(q.logContext, err)
 	}
+	q.recordPreparedStatementUse(true)
 
-	if q.stmt == nil {
-		stmt, err := conn.PrepareContext(ctx, q.config.Query)
-		if err != nil {
-			return nil, errors.Wrapf(q.logContext, err, "prepare query failed")
-		}
-		q.conn = conn
-		q.stmt = stmt
+	stmt, err := q.preparedStmt(ctx, conn)
+	if err != nil {
+		return nil, errors.Wrapf(q.logContext, err, "prepare query failed")
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil && ctx.Err() == nil {
+		// The statement may have been invalidated (e.g. by a schema change), have it prepared again on the next run.
+		q.logger.Debug("Evicting prepared statement after failed execution", "logContext", q.logContext, "error", err)
+		q.evictStmt(stmt)
 	}
-	rows, err := q.stmt.QueryContext(ctx)
 	return rows, errors.Wrap(q.logContext, err)
 }
 
+// rateLimit waits for the rate limiters of the scrape to allow a query of q, logging how long that took.
+func (q *Query) rateLimit(ctx context.Context) errors.WithContext {
+	waited, err := waitRateLimits(ctx)
+	if err != nil {
+		return errors.Wrapf(q.logContext, err, "rate limited")
+	}
+	if waited > 0 {
+		q.logger.Debug("Rate limited", "logContext", q.logContext, "delay", waited)
+	}
+	return nil
+}
+
+// preparedStmt returns the statement of the query prepared on the provided database, preparing it if necessary.
+func (q *Query) preparedStmt(ctx context.Context, conn *sql.DB) (*sql.Stmt, error) {
+	q.stmtMu.Lock()
+	defer q.stmtMu.Unlock()
+
+	if q.stmt != nil && q.conn != conn {
+		// Statements are bound to the handle they were prepared on (e.g. one recycled on reload), prepare it again.
+		q.logger.Warn("Database handle changed, preparing statement again", "logContext", q.logContext)
+		q.evictStmtLocked(q.stmt)
+	}
+	if q.stmt != nil {
+		q.recordStmtCacheEvent(stmtCacheHit)
+		return q.stmt, nil
+	}
+
+	q.recordStmtCacheEvent(stmtCacheMiss)
+	stmt, err := conn.PrepareContext(ctx, q.config.Query)
+	if err != nil {
+		return nil, err
+	}
+	q.conn = conn
+	q.stmt = stmt
+	q.setPreparedStatements(1)
+	return stmt, nil
+}
+
+// evictStmt closes the prepared statement, unless it was already replaced by a concurrent run.
+func (q *Query) evictStmt(stmt *sql.Stmt) {
+	q.stmtMu.Lock()
+	defer q.stmtMu.Unlock()
+	q.evictStmtLocked(stmt)
+}
+
+// evictStmtLocked is evictStmt, with stmtMu held.
+func (q *Query) evictStmtLocked(stmt *sql.Stmt) {
+	if q.stmt != stmt {
+		return
+	}
+	q.stmt.Close()
+	q.stmt = nil
+	q.recordStmtCacheEvent(stmtCacheEviction)
+	q.setPreparedStatements(0)
+}
+
+// recordPreparedStatementUse logs and, if enabled, exports whether the query is executed with a prepared statement.
+func (q *Query) recordPreparedStatementUse(prepared bool) {
+	q.logger.Debug("Executing query", "logContext", q.logContext, "prepared_statement", prepared)
+	if usedPreparedStmtMetric != nil {
+		value := 0.0
+		if prepared {
+			value = 1
+		}
+		usedPreparedStmtMetric.WithLabelValues(svcMetricLabelValues(q.logContext)...).Set(value)
+	}
+}
+
+// Prepared statement cache events.
+const (
+	stmtCacheHit      = "hit"
+	stmtCacheMiss     = "miss"
+	stmtCacheEviction = "eviction"
+)
+
+// recordStmtCacheEvent counts a hit, miss or eviction of the prepared statement cache.
+func (q *Query) recordStmtCacheEvent(event string) {
+	if stmtCacheEventsMetric != nil {
+		stmtCacheEventsMetric.WithLabelValues(svcMetricLabelValues(q.logContext, event)...).Inc()
+	}
+}
+
+// setPreparedStatements records the number of prepared statements cached by the query.
+func (q *Query) setPreparedStatements(n float64) {
+	if preparedStatementsMetric != nil {
+		preparedStatementsMetric.WithLabelValues(svcMetricLabelValues(q.logContext)...).Set(n)
+	}
+}
+
 // scanDest creates a slice to scan the provided rows into, with strings for keys, float64s for values and interface{}
 // for any extra columns.
-func (q *Query) scanDest(rows *sql.Rows) ([]any, errors.WithContext) {
+func (q *Query) scanDest(rows *sql.Rows) (_ []any, werr errors.WithContext) {
+	defer func() { werr = errors.Categorize(werr, errors.CategoryScan) }()
+
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, errors.Wrap(q.logContext, err)
 	}
-	slog.Debug("Returned columns", "logContext", q.logContext, "columns", columns)
+	q.logger.Debug("Returned columns", "logContext", q.logContext, "columns", columns)
+	if queryColumnsMetric != nil {
+		queryColumnsMetric.WithLabelValues(svcMetricLabelValues(q.logContext, "expected")...).Set(float64(len(q.columnTypes)))
+		queryColumnsMetric.WithLabelValues(svcMetricLabelValues(q.logContext, "returned")...).Set(float64(len(columns)))
+	}
+	// Column types are only used to recognize UUID, MySQL ENUM/SET and ClickHouse Nullable/LowCardinality columns, not
+	// all drivers provide them.
+	columnDBTypes, err := rows.ColumnTypes()
+	if err != nil {
+		q.logger.Debug("Unable to get column types", "logContext", q.logContext, "error", err)
+	}
 	// Create the slice to scan the row into, with strings for keys and float64s for values.
 	dest := make([]any, 0, len(columns))
 	have := make(map[string]bool, len(q.columnTypes))
+	returnedAs := make(map[string]string, len(q.columnTypes))
+	var unexpected []string
 	for i, column := range columns {
-		switch q.columnTypes[column] {
+		name, ctype := q.resolveColumn(column)
+		if ctype != 0 {
+			if other, found := returnedAs[name]; found {
+				switch {
+				case q.config.DuplicateColumns == config.DuplicateColumnsFirst:
+					q.logger.Debug("Ignoring duplicate column", "logContext", q.logContext, "column", column, "position", i)
+					dest = append(dest, new(any))
+					continue
+				case q.foldedColumns != nil:
+					return nil, errors.Errorf(q.logContext, "columns %q and %q both match column %q with case insensitive matching",
+						other, column, name)
+				default:
+					return nil, errors.Errorf(q.logContext, "column %q returned more than once", column)
+				}
+			}
+			returnedAs[name] = column
+		}
+		dbType := ""
+		if i < len(columnDBTypes) {
+			dbType = columnDBTypes[i].DatabaseTypeName()
+		}
+		switch ctype {
 		case columnTypeKey:
-			dest = append(dest, new(sql.NullString))
-			have[column] = true
+			switch {
+			case isEnumType(dbType):
+				dest = append(dest, wrapNullable(new(enumString), dbType))
+			case dbType == "UUID":
+				dest = append(dest, new(uuidString))
+			default:
+				dest = append(dest, wrapNullable(new(sql.NullString), dbType))
+			}
+			have[name] = true
 		case columnTypeValue:
-			dest = append(dest, new(sql.NullFloat64))
-			have[column] = true
+			if q.intervalColumns[name] {
+				// Parsed in scanRow.
+				dest = append(dest, wrapNullable(new(sql.NullString), dbType))
+			} else {
+				dest = append(dest, wrapNullable(new(sql.NullFloat64), dbType))
+			}
+			have[name] = true
 		case columnTypeTime:
-			dest = append(dest, new(sql.NullTime))
-			have[column] = true
+			if _, ok := q.timeLayouts[name]; ok {
+				// Parsed in scanRow.
+				dest = append(dest, wrapNullable(new(sql.NullString), dbType))
+			} else {
+				dest = append(dest, wrapNullable(new(sql.NullTime), dbType))
+			}
+			have[name] = true
+		case columnTypeBinary:
+			dest = append(dest, wrapNullable(new(binaryDigest), dbType))
+			have[name] = true
 		default:
 			if column == "" {
-				slog.Debug("Unnamed column", "logContext", q.logContext, "column", i)
+				q.logger.Debug("Unnamed column", "logContext", q.logContext, "column", i)
+				unexpected = append(unexpected, fmt.Sprintf("#%d", i))
 			} else {
-				slog.Debug("Extra column returned by query", "logContext", q.logContext, "column", column)
+				q.logger.Debug("Extra column returned by query", "logContext", q.logContext, "column", column)
+				unexpected = append(unexpected, column)
 			}
 			dest = append(dest, new(any))
 		}
 	}
 
-	// Not all requested columns could be mapped, fail.
+	// Not all requested columns could be mapped, fail unless they have a default.
 	if len(have) != len(q.columnTypes) {
 		missing := make([]string, 0, len(q.columnTypes)-len(have))
 		for c := range q.columnTypes {
-			if !have[c] {
-				missing = append(missing, c)
+			if have[c] {
+				continue
 			}
+			if def, ok := q.keyDefaults[c]; ok {
+				q.logger.Debug("Key column not returned, using default", "logContext", q.logContext, "column", c, "default", def)
+				continue
+			}
+			if def := q.config.MissingValueDefault; def != nil && q.columnTypes[c] == columnTypeValue {
+				q.logger.Debug("Value column not returned, using default", "logContext", q.logContext, "column", c, "default", *def)
+				continue
+			}
+			missing = append(missing, c)
 		}
-		return nil, errors.Errorf(q.logContext, "Missing values for the requested columns: %q", missing)
+		if len(missing) > 0 {
+			return nil, errors.Errorf(q.logContext, "Missing values for the requested columns: %q", missing)
+		}
+	}
+
+	// With strict columns, anything not mapped to a metric is treated as schema drift.
+	if q.config.StrictColumns && len(unexpected) > 0 {
+		return nil, errors.Errorf(q.logContext, "Unexpected columns returned by query: %q", unexpected)
 	}
 
 	return dest, nil
@@ -257,41 +1203,287 @@ func (q *Query) scanDest(rows *sql.Rows) ([]any, errors.WithContext) {
 
 // scanRow scans the current row into a map of column name to value, with string values for key columns and float64
 // values for value columns, using dest as a buffer.
-func (q *Query) scanRow(rows *sql.Rows, dest []any) (map[string]any, errors.WithContext) {
+func (q *Query) scanRow(rows *sql.Rows, dest []any) (_ map[string]any, werr errors.WithContext) {
+	defer func() { werr = errors.Categorize(werr, errors.CategoryScan) }()
+
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, errors.Wrap(q.logContext, err)
 	}
 
 	// Scan the row content into dest.
-	if err := rows.Scan(dest...); err != nil {
+	if q.config.LenientScan {
+		err = q.scanColumns(rows, columns, dest)
+	} else {
+		err = rows.Scan(dest...)
+	}
+	if err != nil {
 		return nil, errors.Wrapf(q.logContext, err, "scanning of query result failed")
 	}
 
 	// Pick all values we're interested in into a map.
 	result := make(map[string]any, len(q.columnTypes))
 	for i, column := range columns {
-		switch q.columnTypes[column] {
+		// Extra (or ignored duplicate) columns.
+		if _, ok := dest[i].(*any); ok {
+			continue
+		}
+		name, ctype := q.resolveColumn(column)
+		switch ctype {
 		case columnTypeKey:
-			if !dest[i].(*sql.NullString).Valid {
-				slog.Debug("Key column is NULL", "logContext", q.logContext, "column", column)
+			v := keyString(unwrapNullable(dest[i]))
+			if v.Valid && v.String == "" && q.emptyAsNull[name] {
+				v.Valid = false
+			}
+			if !v.Valid {
+				q.logger.Debug("Key column is NULL", "logContext", q.logContext, "column", column)
 			}
-			result[column] = *dest[i].(*sql.NullString)
+			result[name] = *v
 		case columnTypeTime:
-			if !dest[i].(*sql.NullTime).Valid {
-				slog.Debug("Time column is NULL", "logContext", q.logContext, "column", column)
+			v, err := q.scanTime(name, unwrapNullable(dest[i]))
+			if err != nil {
+				q.logger.Warn("Unable to parse time column", "logContext", q.logContext, "column", column, "error", err)
+			} else if !v.Valid {
+				q.logger.Debug("Time column is NULL", "logContext", q.logContext, "column", column)
 			}
-			result[column] = *dest[i].(*sql.NullTime)
+			result[name] = v
 		case columnTypeValue:
-			if !dest[i].(*sql.NullFloat64).Valid {
-				slog.Debug("Value column is NULL", "logContext", q.logContext, "column", column)
+			v, err := scanValue(unwrapNullable(dest[i]))
+			if err != nil {
+				q.logger.Warn("Unable to parse interval column", "logContext", q.logContext, "column", column, "error", err)
+			} else if !v.Valid {
+				q.logger.Debug("Value column is NULL", "logContext", q.logContext, "column", column)
+			}
+			result[name] = v
+		case columnTypeBinary:
+			result[name] = *unwrapNullable(dest[i]).(*binaryDigest)
+		}
+	}
+	// Fill in the defaults of key columns not returned by the query.
+	for name, def := range q.keyDefaults {
+		if _, found := result[name]; !found {
+			result[name] = sql.NullString{String: def, Valid: true}
+		}
+	}
+	// And the default of value columns, so the metrics of the columns returned are still exported.
+	if def := q.config.MissingValueDefault; def != nil && len(result) < len(q.columnTypes) {
+		for name, ctype := range q.columnTypes {
+			if _, found := result[name]; !found && ctype == columnTypeValue {
+				result[name] = sql.NullFloat64{Float64: *def, Valid: true}
 			}
-			result[column] = *dest[i].(*sql.NullFloat64)
 		}
 	}
 	return result, nil
 }
 
+// scanValue returns the value of a value column as scanned into dest, parsing it into seconds if it's an interval
+// returned as a string. Unparsable intervals are returned as invalid, along with the parsing error.
+func scanValue(dest any) (sql.NullFloat64, error) {
+	s, ok := dest.(*sql.NullString)
+	if !ok {
+		return *dest.(*sql.NullFloat64), nil
+	}
+	if !s.Valid {
+		return sql.NullFloat64{}, nil
+	}
+	seconds, err := parseInterval(s.String)
+	if err != nil {
+		return sql.NullFloat64{}, err
+	}
+	return sql.NullFloat64{Float64: seconds, Valid: true}, nil
+}
+
+// timeLayout is the layout of a time column returned as a string, and the zone of values without zone information.
+type timeLayout struct {
+	layout string
+	loc    *time.Location
+}
+
+// scanTime returns the value of a time column as scanned into dest, parsing it with the layout of the column if it's
+// returned as a string (or an epoch, scanned as a string too). Unparsable values are returned as invalid, along with the parsing error.
+func (q *Query) scanTime(name string, dest any) (sql.NullTime, error) {
+	s, ok := dest.(*sql.NullString)
+	if !ok {
+		return *dest.(*sql.NullTime), nil
+	}
+	if !s.Valid {
+		return sql.NullTime{}, nil
+	}
+	layout := q.timeLayouts[name]
+	t, err := parseTimestamp(s.String, layout.layout, layout.loc)
+	if err != nil {
+		return sql.NullTime{}, err
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// enumString scans MySQL ENUM and SET columns (which some drivers return as raw bytes) into clean string labels.
+type enumString struct {
+	sql.NullString
+}
+
+// isEnumType returns whether a database type name is that of a MySQL ENUM or SET column.
+func isEnumType(name string) bool {
+	return name == "ENUM" || name == "SET"
+}
+
+// Scan implements sql.Scanner.
+func (s *enumString) Scan(src any) error {
+	if err := s.NullString.Scan(src); err != nil {
+		return err
+	}
+	// ENUM and SET members never have trailing spaces, MySQL strips them from the column definition.
+	s.String = strings.TrimRight(strings.ToValidUTF8(s.String, "\uFFFD"), " \x00")
+	return nil
+}
+
+// uuidString scans UUID columns into their canonical hyphenated form, whether the driver returns them as text or as
+// 16 raw bytes.
+type uuidString struct {
+	sql.NullString
+}
+
+// Scan implements sql.Scanner.
+func (s *uuidString) Scan(src any) error {
+	switch v := src.(type) {
+	case [16]byte:
+		src = formatUUID(v[:])
+	case []byte:
+		if len(v) == 16 {
+			src = formatUUID(v)
+		}
+	}
+	return s.NullString.Scan(src)
+}
+
+// formatUUID formats 16 bytes as a UUID, e.g. "123e4567-e89b-12d3-a456-426614174000".
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// keyString returns the string a key column was scanned into.
+func keyString(dest any) *sql.NullString {
+	switch d := dest.(type) {
+	case *enumString:
+		return &d.NullString
+	case *uuidString:
+		return &d.NullString
+	}
+	return dest.(*sql.NullString)
+}
+
+// binaryDigest scans a binary column into its CRC32 checksum and length, without keeping the (possibly large) content.
+type binaryDigest struct {
+	CRC32  uint32
+	Length int
+	Valid  bool // false if NULL
+}
+
+// Scan implements sql.Scanner.
+func (d *binaryDigest) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*d = binaryDigest{}
+	case []byte:
+		*d = binaryDigest{CRC32: crc32.ChecksumIEEE(v), Length: len(v), Valid: true}
+	case string:
+		*d = binaryDigest{CRC32: crc32.ChecksumIEEE([]byte(v)), Length: len(v), Valid: true}
+	default:
+		return fmt.Errorf("unsupported type %T for binary column", src)
+	}
+	return nil
+}
+
+// nullableDest scans ClickHouse Nullable and LowCardinality columns, which the driver may return as pointers (nil for
+// NULL) that the database/sql conversions don't handle, into the wrapped NULL-able destination.
+type nullableDest struct {
+	dest sql.Scanner
+}
+
+// wrapNullable wraps dest into a nullableDest for ClickHouse Nullable and LowCardinality column types, returning it
+// as is otherwise.
+func wrapNullable(dest sql.Scanner, dbType string) any {
+	if strings.HasPrefix(dbType, "Nullable(") || strings.HasPrefix(dbType, "LowCardinality(") {
+		return nullableDest{dest: dest}
+	}
+	return dest
+}
+
+// unwrapNullable returns the destination wrapped by a nullableDest, or dest itself.
+func unwrapNullable(dest any) any {
+	if n, ok := dest.(nullableDest); ok {
+		return n.dest
+	}
+	return dest
+}
+
+// Scan implements sql.Scanner.
+func (n nullableDest) Scan(src any) error {
+	if v := reflect.ValueOf(src); v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			src = nil
+		} else {
+			src = v.Elem().Interface()
+		}
+	}
+	return n.dest.Scan(src)
+}
+
+// splitSets expands a row into one row per combination of the members of its SET columns, comma separated. NULL and
+// empty SET values are kept as they are.
+func splitSets(row map[string]any, columns []string) []map[string]any {
+	rows := []map[string]any{row}
+	for _, col := range columns {
+		v, _ := row[col].(sql.NullString)
+		if !v.Valid || !strings.Contains(v.String, ",") {
+			continue
+		}
+		members := strings.Split(v.String, ",")
+		split := make([]map[string]any, 0, len(rows)*len(members))
+		for _, r := range rows {
+			for _, member := range members {
+				c := maps.Clone(r)
+				c[col] = sql.NullString{String: member, Valid: true}
+				split = append(split, c)
+			}
+		}
+		rows = split
+	}
+	return rows
+}
+
+// scanColumns scans the current row into dest one column at a time, so a column that fails to convert is recorded as
+// a scan error and left NULL instead of failing the whole row. It returns an error if the row couldn't be read at all,
+// leaving dest as it was.
+func (q *Query) scanColumns(rows *sql.Rows, columns []string, dest []any) error {
+	raw := make([]any, len(dest))
+	rawPtrs := make([]any, len(dest))
+	for i := range raw {
+		rawPtrs[i] = &raw[i]
+	}
+	// Scanning into *any doesn't convert anything, so it can't fail on a single column.
+	if err := rows.Scan(rawPtrs...); err != nil {
+		return err
+	}
+
+	for i, column := range columns {
+		scanner, ok := dest[i].(sql.Scanner)
+		if !ok {
+			*dest[i].(*any) = raw[i]
+			continue
+		}
+		if err := scanner.Scan(raw[i]); err != nil {
+			q.logger.Debug("Column scan failed", "logContext", q.logContext, "column", column, "error", err)
+			// Reset to NULL, so the column is handled like a missing value.
+			_ = scanner.Scan(nil)
+			if columnScanErrorsMetric != nil {
+				columnScanErrorsMetric.WithLabelValues(svcMetricLabelValues(q.logContext, column)...).Inc()
+			}
+		}
+	}
+	return nil
+}
+
 // shouldIncludeRow checks if a row matches the configured row filters
 func (q *Query) shouldIncludeRow(row map[string]any, metric *config.MetricConfig) bool {
 	for _, filter := range metric.RowFilters {
@@ -308,58 +1500,168 @@ func (q *Query) applyRowFilter(row map[string]any, filter config.RowFilter) bool
 	if !exists {
 		return false
 	}
+	valueStr, ok := filterValueString(value)
+	if !ok {
+		return false
+	}
 
-	// Handle sql.NullString, sql.NullFloat64, sql.NullTime types from updated codebase
-	var valueStr string
-	switch v := value.(type) {
-	case sql.NullString:
-		if !v.Valid {
-			return false
-		}
-		valueStr = v.String
-	case sql.NullFloat64:
-		if !v.Valid {
+	// Compare against another column of the row, if configured
+	operand := filter.Value
+	if filter.CompareColumn != "" {
+		compareValue, exists := row[filter.CompareColumn]
+		if !exists {
 			return false
 		}
-		valueStr = fmt.Sprintf("%v", v.Float64)
-	case sql.NullTime:
-		if !v.Valid {
+		if operand, ok = filterValueString(compareValue); !ok {
 			return false
 		}
-		valueStr = v.Time.Format("2006-01-02 15:04:05.000 UTC")
-	default:
-		valueStr = fmt.Sprintf("%v", value)
 	}
 
 	switch filter.Operator {
 	case "equals":
-		return valueStr == filter.Value
+		return filterEquals(value, valueStr, operand)
 	case "not_equals":
-		return valueStr != filter.Value
+		return !filterEquals(value, valueStr, operand)
 	case "in":
 		for _, v := range filter.Values {
-			if valueStr == v {
+			if filterEquals(value, valueStr, v) {
 				return true
 			}
 		}
 		return false
 	case "not_in":
 		for _, v := range filter.Values {
-			if valueStr == v {
+			if filterEquals(value, valueStr, v) {
 				return false
 			}
 		}
 		return true
 	case "contains":
-		return strings.Contains(valueStr, filter.Value)
+		return strings.Contains(valueStr, operand)
+	case "contains_any":
+		for _, v := range filter.Values {
+			if strings.Contains(valueStr, v) {
+				return true
+			}
+		}
+		return false
+	case "contains_all":
+		for _, v := range filter.Values {
+			if !strings.Contains(valueStr, v) {
+				return false
+			}
+		}
+		return true
+	case "between", "not_between":
+		// Bounds are parsed and validated when loading the configuration
+		low, high := filter.Bounds()
+		v, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return false
+		}
+		inRange := v >= low && v <= high
+		return inRange == (filter.Operator == "between")
+	case "greater_than", "greater_or_equal", "less_than", "less_or_equal":
+		left, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			return false
+		}
+		right, err := strconv.ParseFloat(operand, 64)
+		if err != nil {
+			return false
+		}
+		switch filter.Operator {
+		case "greater_than":
+			return left > right
+		case "greater_or_equal":
+			return left >= right
+		case "less_than":
+			return left < right
+		default:
+			return left <= right
+		}
 	default:
-		slog.Warn("Unknown filter operator", "operator", filter.Operator)
+		q.logger.Warn("Unknown filter operator", "operator", filter.Operator)
 		return true
 	}
 }
 
-// applyTransformations applies configured transformations like lag calculations to a row
-func (q *Query) applyTransformations(row map[string]any, metric *config.MetricConfig) map[string]any {
+// filterValueString returns the string form of a row value that row filters compare, false if the value is NULL.
+func filterValueString(value any) (string, bool) {
+	// Handle sql.NullString, sql.NullFloat64, sql.NullTime types from updated codebase
+	switch v := value.(type) {
+	case sql.NullString:
+		return v.String, v.Valid
+	case sql.NullFloat64:
+		return strconv.FormatFloat(v.Float64, 'f', -1, 64), v.Valid
+	case sql.NullTime:
+		return v.Time.Format("2006-01-02 15:04:05.000 UTC"), v.Valid
+	default:
+		return fmt.Sprintf("%v", value), true
+	}
+}
+
+// parseComposite splits a PostgreSQL composite literal, e.g. `(42,"eu ""west""",)`, into its fields. Fields may be
+// double-quoted, with doubled quotes standing for quotes, and backslashes escape the next character. Empty unquoted
+// fields are NULL.
+func parseComposite(s string) ([]sql.NullString, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return nil, fmt.Errorf("not enclosed in parentheses")
+	}
+	body := s[1 : len(s)-1]
+
+	var (
+		fields   []sql.NullString
+		field    strings.Builder
+		valid    bool // whether the field has any content, even an empty quoted string
+		inQuotes bool
+	)
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\\':
+			if i++; i == len(body) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			field.WriteByte(body[i])
+			valid = true
+		case c == '"' && inQuotes:
+			if i+1 < len(body) && body[i+1] == '"' {
+				field.WriteByte('"')
+				i++
+			} else {
+				inQuotes = false
+			}
+		case c == '"':
+			inQuotes, valid = true, true
+		case c == ',' && !inQuotes:
+			fields = append(fields, sql.NullString{String: field.String(), Valid: valid})
+			field.Reset()
+			valid = false
+		default:
+			field.WriteByte(c)
+			valid = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted field")
+	}
+	return append(fields, sql.NullString{String: field.String(), Valid: valid}), nil
+}
+
+// filterEquals returns whether a row value, in its string form valueStr, equals a filter operand. Numeric values are
+// compared numerically with numeric operands, regardless of their formatting.
+func filterEquals(value any, valueStr, operand string) bool {
+	if v, ok := value.(sql.NullFloat64); ok {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(operand), 64); err == nil {
+			return v.Float64 == n
+		}
+	}
+	return valueStr == operand
+}
+
+// applyTransformations applies configured transformations like lag calculations to a row, returned in schema (if any)
+func (q *Query) applyTransformations(row map[string]any, schema string, metric *config.MetricConfig) map[string]any {
 	result := make(map[string]any)
 
 	// Copy original row data
@@ -367,12 +1669,202 @@ func (q *Query) applyTransformations(row map[string]any, metric *config.MetricCo
 		result[k] = v
 	}
 
+	// Apply string value parsing
+	for _, pv := range metric.ParsedValues {
+		if sourceValue, exists := row[pv.SourceColumn]; exists {
+			result[pv.OutputColumn] = q.parseValue(sourceValue, pv)
+		}
+	}
+
+	// Apply duration parsing, NULL if the duration is NULL or invalid
+	for _, d := range metric.Durations {
+		result[d.OutputColumn] = sql.NullFloat64{}
+		if v, ok := row[d.SourceColumn].(sql.NullString); ok && v.Valid {
+			seconds, err := parseDuration(v.String)
+			if err != nil {
+				q.logger.Warn("Failed to parse duration", "logContext", q.logContext, "value", v.String, "column", d.SourceColumn,
+					"error", err)
+				continue
+			}
+			result[d.OutputColumn] = sql.NullFloat64{Float64: seconds, Valid: true}
+		}
+	}
+
+	// Apply binary digests, NULL if the source is NULL
+	for _, d := range metric.BinaryDigests {
+		result[d.OutputColumn] = sql.NullFloat64{}
+		if v, ok := row[d.SourceColumn].(binaryDigest); ok && v.Valid {
+			value := float64(v.CRC32)
+			if d.Function == config.BinaryDigestLength {
+				value = float64(v.Length)
+			}
+			result[d.OutputColumn] = sql.NullFloat64{Float64: value, Valid: true}
+		}
+	}
+
+	// Apply checksums, NULL if the source is NULL
+	for _, c := range metric.Checksums {
+		result[c.OutputColumn] = sql.NullFloat64{}
+		if v, ok := row[c.SourceColumn].(sql.NullString); ok && v.Valid {
+			result[c.OutputColumn] = sql.NullFloat64{Float64: float64(crc32.ChecksumIEEE([]byte(v.String))), Valid: true}
+		}
+	}
+
+	// Apply splits, outputs are NULL unless their key is found
+	for _, s := range metric.Splits {
+		for _, col := range s.Keys {
+			result[col] = sql.NullString{}
+		}
+		v, ok := row[s.SourceColumn].(sql.NullString)
+		if !ok || !v.Valid {
+			continue
+		}
+		for _, segment := range strings.Split(v.String, s.Delimiter) {
+			key, value, found := strings.Cut(segment, s.Separator)
+			if !found {
+				if strings.TrimSpace(segment) != "" {
+					q.logger.Debug("Ignoring malformed segment", "logContext", q.logContext, "column", s.SourceColumn,
+						"segment", segment)
+				}
+				continue
+			}
+			if col, ok := s.Keys[strings.TrimSpace(key)]; ok {
+				result[col] = sql.NullString{String: strings.TrimSpace(value), Valid: true}
+			}
+		}
+	}
+
+	// Apply composites, fields are NULL if the composite or the field itself is NULL
+	for _, c := range metric.Composites {
+		var fields []sql.NullString
+		if v, ok := row[c.SourceColumn].(sql.NullString); ok && v.Valid {
+			var err error
+			if fields, err = parseComposite(v.String); err != nil {
+				q.logger.Debug("Ignoring malformed composite", "logContext", q.logContext, "column", c.SourceColumn,
+					"value", v.String, "error", err)
+			}
+		}
+		for i, col := range c.Fields {
+			if col == "" {
+				continue
+			}
+			var field sql.NullString
+			if i < len(fields) {
+				field = fields[i]
+			}
+			if !slices.Contains(metric.Values, col) {
+				result[col] = field
+				continue
+			}
+			result[col] = sql.NullFloat64{}
+			switch f := strings.TrimSpace(field.String); {
+			case !field.Valid:
+			case f == "t" || f == "f":
+				result[col] = sql.NullFloat64{Float64: boolToFloat64(f == "t"), Valid: true}
+			default:
+				if n, err := strconv.ParseFloat(f, 64); err == nil {
+					result[col] = sql.NullFloat64{Float64: n, Valid: true}
+				}
+			}
+		}
+	}
+
+	// Apply coalesce, NULL only if all source columns are NULL
+	for _, c := range metric.Coalesces {
+		coalesced := sql.NullFloat64{}
+		for _, col := range c.SourceColumns {
+			if v, ok := row[col].(sql.NullFloat64); ok && v.Valid {
+				coalesced = v
+				break
+			}
+		}
+		result[c.OutputColumn] = coalesced
+	}
+
+	// Apply percentages, NULL if either column is NULL or the whole is zero
+	for _, p := range metric.Percents {
+		result[p.OutputColumn] = sql.NullFloat64{}
+		part, ok1 := row[p.PartColumn].(sql.NullFloat64)
+		whole, ok2 := row[p.WholeColumn].(sql.NullFloat64)
+		if !ok1 || !ok2 || !part.Valid || !whole.Valid {
+			continue
+		}
+		if whole.Float64 == 0 {
+			q.logger.Debug("Whole column is zero, no percentage", "logContext", q.logContext, "column", p.WholeColumn)
+			continue
+		}
+		pct := part.Float64 / whole.Float64 * 100
+		if p.Clamp {
+			pct = min(max(pct, 0), 100)
+		}
+		result[p.OutputColumn] = sql.NullFloat64{Float64: pct, Valid: true}
+	}
+
+	// Apply deltas against the previous scrape
+	for _, d := range metric.Deltas {
+		result[d.OutputColumn] = sql.NullFloat64{}
+		if v, ok := row[d.SourceColumn].(sql.NullFloat64); ok && v.Valid {
+			delta, ok := q.deltas.delta(deltaKey(row, metric, schema, d.SourceColumn), v.Float64)
+			result[d.OutputColumn] = sql.NullFloat64{Float64: delta, Valid: ok}
+		}
+	}
+
+	// Apply bucketize, the output label is empty if the source value is NULL
+	for _, b := range metric.Buckets {
+		result[b.OutputColumn] = sql.NullString{}
+		if v, ok := row[b.SourceColumn].(sql.NullFloat64); ok && v.Valid {
+			result[b.OutputColumn] = sql.NullString{String: bucketLabel(v.Float64, b), Valid: true}
+		}
+	}
+
+	// Apply elapsed times between timestamp columns
+	for _, e := range metric.Elapsed {
+		result[e.OutputColumn] = q.elapsed(row, e)
+	}
+
 	// Apply lag calculations
 	for _, lagCalc := range metric.LagCalculations {
 		if sourceValue, exists := row[lagCalc.SourceColumn]; exists {
-			lagSeconds := q.calculateLag(sourceValue, lagCalc.TimestampFormat)
-			// Create a sql.NullFloat64 to match the expected type system
-			result[lagCalc.OutputColumn] = sql.NullFloat64{Float64: lagSeconds, Valid: lagSeconds != 0}
+			lag, isNull := q.calculateLag(sourceValue, &lagCalc)
+			if isNull && lagCalc.NullValue != nil {
+				lag = sql.NullFloat64{Float64: *lagCalc.NullValue, Valid: true}
+			}
+			result[lagCalc.OutputColumn] = lag
+		}
+	}
+
+	// Apply absolute values to the final values, NULL being left NULL
+	for _, col := range metric.Abs {
+		if v, ok := result[col].(sql.NullFloat64); ok && v.Valid {
+			result[col] = sql.NullFloat64{Float64: math.Abs(v.Float64), Valid: true}
+		}
+	}
+
+	// Clamp the final values to their range, counting those out of it
+	for _, c := range metric.Clamps {
+		v, ok := result[c.Column].(sql.NullFloat64)
+		if !ok || !v.Valid || math.IsNaN(v.Float64) {
+			continue
+		}
+		clamped := v.Float64
+		if c.Min != nil {
+			clamped = max(clamped, *c.Min)
+		}
+		if c.Max != nil {
+			clamped = min(clamped, *c.Max)
+		}
+		if clamped != v.Float64 {
+			result[c.Column] = sql.NullFloat64{Float64: clamped, Valid: true}
+			if clampedValuesMetric != nil {
+				clampedValuesMetric.WithLabelValues(svcMetricLabelValues(q.logContext, c.Column)...).Inc()
+			}
+		}
+	}
+
+	// Apply rounding last, to the final values
+	for _, r := range metric.Rounds {
+		if v, ok := result[r.Column].(sql.NullFloat64); ok && v.Valid {
+			result[r.Column] = sql.NullFloat64{Float64: roundValue(v.Float64, r), Valid: true}
 		}
 	}
 
@@ -390,10 +1882,31 @@ func (q *Query) applyTransformations(row map[string]any, metric *config.MetricCo
 	return result
 }
 
-// calculateLag calculates the lag in seconds between a timestamp and current time
-func (q *Query) calculateLag(timestampValue any, format string) float64 {
+// roundValue rounds (or truncates) value to the configured multiple or number of decimal places.
+func roundValue(value float64, r config.Round) float64 {
+	f := math.Round
+	if r.Truncate {
+		f = math.Trunc
+	}
+	if r.Multiple > 0 {
+		return f(value/r.Multiple) * r.Multiple
+	}
+	p := math.Pow10(r.Decimals)
+	return f(value*p) / p
+}
+
+// bucketLabel returns the label of the first bucket whose upper boundary is greater than or equal to value, or the last
+// label if value is above all boundaries.
+func bucketLabel(value float64, b config.Bucketize) string {
+	i, _ := slices.BinarySearch(b.Boundaries, value)
+	return b.Labels[i]
+}
+
+// calculateLag calculates the lag in seconds between a timestamp and current time. The lag is NULL if the timestamp is
+// NULL (or empty), in which case isNull is set, or if it cannot be parsed.
+func (q *Query) calculateLag(timestampValue any, lc *config.LagCalculation) (lag sql.NullFloat64, isNull bool) {
 	if timestampValue == nil {
-		return 0
+		return sql.NullFloat64{}, true
 	}
 
 	var timestampStr string
@@ -402,15 +1915,15 @@ func (q *Query) calculateLag(timestampValue any, format string) float64 {
 	switch v := timestampValue.(type) {
 	case sql.NullString:
 		if !v.Valid {
-			return 0
+			return sql.NullFloat64{}, true
 		}
 		timestampStr = v.String
 	case sql.NullTime:
 		if !v.Valid {
-			return 0
+			return sql.NullFloat64{}, true
 		}
 		// Calculate lag directly from time.Time
-		return time.Since(v.Time).Seconds()
+		return sql.NullFloat64{Float64: time.Since(v.Time).Seconds(), Valid: true}, false
 	case string:
 		timestampStr = v
 	default:
@@ -418,22 +1931,318 @@ func (q *Query) calculateLag(timestampValue any, format string) float64 {
 	}
 
 	if timestampStr == "" {
-		return 0
+		return sql.NullFloat64{}, true
+	}
+
+	parsedTime, err := parseTimestamp(timestampStr, lc.TimestampFormat, lc.Location())
+	if err != nil {
+		q.logger.Warn("Failed to parse timestamp for lag calculation", "timestamp", timestampStr, "format", lc.TimestampFormat,
+			"error", err)
+		return sql.NullFloat64{}, false
+	}
+
+	// Calculate lag in seconds, from the time normalized to UTC
+	return sql.NullFloat64{Float64: time.Since(parsedTime.UTC()).Seconds(), Valid: true}, false
+}
+
+// parseTimestamp parses a timestamp, either in seconds/milliseconds since the epoch or in a (named or Go) layout.
+// Timestamps without zone information are in the provided zone. Fractional seconds may have any number of digits,
+// whatever the layout says.
+func parseTimestamp(s, format string, loc *time.Location) (time.Time, error) {
+	switch format {
+	case config.TimeLayoutUnix, config.TimeLayoutUnixMilli:
+		n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if format == config.TimeLayoutUnixMilli {
+			n /= 1e3
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	default:
+		return time.ParseInLocation(flexibleFraction(config.TimestampLayout(format)), s, loc)
+	}
+}
+
+// flexibleFraction rewrites the fixed-width fractional seconds of a layout (e.g. .000) into their variable-width
+// equivalent (.999), accepting any number of digits or none at all, since databases drop trailing zeros or return
+// 0, 3, 6 or 9 digits depending on the column type. Layouts without fractional seconds already accept them.
+func flexibleFraction(layout string) string {
+	b := []byte(layout)
+	for i := 0; i < len(b)-1; i++ {
+		if (b[i] != '.' && b[i] != ',') || b[i+1] != '0' {
+			continue
+		}
+		j := i + 1
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		// Same as Go, digits following the zeros make it something else (e.g. the month of 02.01.2006).
+		if j < len(b) && b[j] >= '0' && b[j] <= '9' {
+			continue
+		}
+		for k := i + 1; k < j; k++ {
+			b[k] = '9'
+		}
+		i = j - 1
+	}
+	return string(b)
+}
+
+// elapsed returns the time elapsed between the start and end timestamps of a row in the configured unit, NULL if either
+// is NULL or can't be parsed.
+func (q *Query) elapsed(row map[string]any, e config.Elapsed) sql.NullFloat64 {
+	var times [2]time.Time
+	for i, col := range []string{e.StartColumn, e.EndColumn} {
+		v, ok := row[col].(sql.NullString)
+		if !ok || !v.Valid || v.String == "" {
+			return sql.NullFloat64{}
+		}
+		t, err := parseTimestamp(v.String, e.TimestampFormat, e.Location())
+		if err != nil {
+			q.logger.Warn("Failed to parse timestamp for elapsed time", "logContext", q.logContext, "column", col,
+				"timestamp", v.String, "format", e.TimestampFormat, "error", err)
+			return sql.NullFloat64{}
+		}
+		times[i] = t
+	}
+	return sql.NullFloat64{Float64: float64(times[1].Sub(times[0])) / float64(config.ElapsedUnits[e.Unit]), Valid: true}
+}
+
+// parseValue extracts a float from a string column value, optionally stripping substrings and applying a regex first
+func (q *Query) parseValue(sourceValue any, pv config.ParsedValue) sql.NullFloat64 {
+	v, ok := sourceValue.(sql.NullString)
+	if !ok || !v.Valid {
+		return sql.NullFloat64{}
 	}
 
-	// Default format for Trino timestamps
-	if format == "" {
-		format = "2006-01-02 15:04:05.000 UTC"
+	valueStr := v.String
+	for _, s := range pv.Strip {
+		valueStr = strings.ReplaceAll(valueStr, s, "")
+	}
+	if pv.Money {
+		valueStr = normalizeMoney(valueStr, pv.ThousandsSeparator, pv.DecimalSeparator)
+	}
+	if re := pv.Regexp(); re != nil {
+		match := re.FindStringSubmatch(valueStr)
+		switch {
+		case match == nil:
+			q.logger.Warn("Failed to match pattern for value parsing", "logContext", q.logContext, "value", v.String, "pattern", pv.Pattern)
+			return sql.NullFloat64{}
+		case len(match) > 1:
+			valueStr = match[1]
+		default:
+			valueStr = match[0]
+		}
 	}
 
-	// Parse the timestamp
-	parsedTime, err := time.Parse(format, timestampStr)
+	value, err := strconv.ParseFloat(strings.TrimSpace(valueStr), 64)
 	if err != nil {
-		slog.Warn("Failed to parse timestamp for lag calculation", "timestamp", timestampStr, "format", format, "error", err)
-		return 0
+		q.logger.Warn("Failed to parse value", "logContext", q.logContext, "value", v.String, "column", pv.SourceColumn, "error", err)
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: value, Valid: true}
+}
+
+// normalizeMoney turns a monetary amount into a number strconv.ParseFloat accepts, removing currency symbols, spaces and
+// thousands separators, using a dot as decimal separator and a minus sign for amounts in parentheses.
+func normalizeMoney(s, thousands, decimal string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Sc, r) || unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = "-" + s[1:len(s)-1]
+	}
+	s = strings.ReplaceAll(s, thousands, "")
+	return strings.Replace(s, decimal, ".", 1)
+}
+
+// iso8601Duration matches ISO-8601 durations, e.g. "P1DT2H30M" or "PT0.5S".
+var iso8601Duration = regexp.MustCompile(`^(-)?P(?:([\d.]+)Y)?(?:([\d.]+)M)?(?:([\d.]+)W)?(?:([\d.]+)D)?(?:T(?:([\d.]+)H)?(?:([\d.]+)M)?(?:([\d.]+)S)?)?$`)
+
+// Seconds per unit of the iso8601Duration capture groups, years and months being approximated as 365 and 30 days.
+var iso8601DurationUnits = []float64{365 * 86400, 30 * 86400, 7 * 86400, 86400, 3600, 60, 1}
+
+// parseDuration returns the number of seconds of an ISO-8601 or Go duration string.
+func parseDuration(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	m := iso8601Duration.FindStringSubmatch(s)
+	// A bare "P" or a trailing "T" match the pattern without any component, neither is a valid duration.
+	if m == nil || strings.TrimPrefix(s, "-") == "P" || strings.HasSuffix(s, "T") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		return d.Seconds(), nil
+	}
+
+	seconds := 0.0
+	for i, unit := range iso8601DurationUnits {
+		if m[i+2] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[i+2], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		seconds += n * unit
+	}
+	if m[1] != "" {
+		seconds = -seconds
+	}
+	return seconds, nil
+}
+
+// Seconds per unit of Postgres interval text, years and months being approximated as 365.25 and 30 days like
+// EXTRACT(EPOCH FROM interval) does.
+var intervalUnits = map[string]float64{
+	"year": 365.25 * 86400, "years": 365.25 * 86400,
+	"mon": 30 * 86400, "mons": 30 * 86400, "month": 30 * 86400, "months": 30 * 86400,
+	"week": 7 * 86400, "weeks": 7 * 86400,
+	"day": 86400, "days": 86400,
+	"hour": 3600, "hours": 3600,
+	"min": 60, "mins": 60, "minute": 60, "minutes": 60,
+	"sec": 1, "secs": 1, "second": 1, "seconds": 1,
+}
+
+// parseInterval returns the number of seconds of an interval: a (signed) HH:MM[:SS[.fff]] time with any number of
+// hours (e.g. MySQL TIME), Postgres interval text like "1 year 2 mons -3 days +04:05:06.5", a plain number of seconds,
+// or an ISO-8601 or Go duration.
+func parseInterval(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return seconds, nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+	seconds := 0.0
+	for i := 0; i < len(fields); i++ {
+		if strings.Contains(fields[i], ":") {
+			clock, err := parseClock(fields[i])
+			if err != nil {
+				// Not interval text, possibly a duration.
+				return parseDuration(s)
+			}
+			seconds += clock
+			continue
+		}
+		n, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || i+1 == len(fields) || intervalUnits[fields[i+1]] == 0 {
+			return parseDuration(s)
+		}
+		i++
+		seconds += n * intervalUnits[fields[i]]
+	}
+	return seconds, nil
+}
+
+// parseClock returns the number of seconds of a (signed) HH:MM[:SS[.fff]] time, hours being unbounded.
+func parseClock(s string) (float64, error) {
+	sign := 1.0
+	switch {
+	case strings.HasPrefix(s, "-"):
+		sign, s = -1, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
 	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	seconds := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		// Only the seconds may have a fraction.
+		if err != nil || n < 0 || (i < 2 && strings.Contains(part, ".")) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		seconds += n * []float64{3600, 60, 1}[i]
+	}
+	return sign * seconds, nil
+}
+
+// deltaKey identifies the series of a delta transformation by metric, schema, source column and key label values. The
+// schema label isn't a key label, so each schema is told apart explicitly.
+func deltaKey(row map[string]any, metric *config.MetricConfig, schema, column string) string {
+	parts := make([]string, 0, len(metric.KeyLabels)+3)
+	parts = append(parts, metric.Name, schema, column)
+	for _, label := range metric.KeyLabels {
+		if v, ok := row[label].(sql.NullString); ok {
+			parts = append(parts, v.String)
+		}
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// deltaTracker remembers the values delta transformations were computed from, per series, between scrapes.
+type deltaTracker struct {
+	mu         sync.Mutex
+	generation uint64
+	failed     bool // the current scrape generation had errors
+	previous   map[string]deltaSample
+}
+
+// deltaSample is a value seen by a delta transformation, along with the scrape generation it was last seen in.
+type deltaSample struct {
+	value      float64
+	generation uint64
+}
+
+func newDeltaTracker() *deltaTracker {
+	return &deltaTracker{previous: make(map[string]deltaSample)}
+}
+
+// begin starts a new scrape generation.
+func (d *deltaTracker) begin() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generation++
+	d.failed = false
+}
 
-	// Calculate lag in seconds
-	lag := time.Since(parsedTime).Seconds()
-	return lag
+// fail records an error in the current scrape generation.
+func (d *deltaTracker) fail() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failed = true
+}
+
+// delta records the value for the series and returns its increase since the previous scrape. It returns false if the
+// series wasn't seen before.
+func (d *deltaTracker) delta(key string, value float64) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev, found := d.previous[key]
+	d.previous[key] = deltaSample{value: value, generation: d.generation}
+	switch {
+	case !found:
+		return 0, false
+	case value < prev.value:
+		// Counter reset, the new value is the increase since the reset.
+		return value, true
+	default:
+		return value - prev.value, true
+	}
+}
+
+// prune drops the series not seen in the current scrape generation, unless it had errors: the series missing from a
+// failed scrape may well still be there, and dropping them would lose their deltas on the next scrape.
+func (d *deltaTracker) prune() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failed {
+		return
+	}
+	for key, sample := range d.previous {
+		if sample.generation != d.generation {
+			delete(d.previous, key)
+		}
+	}
 }
@@ -0,0 +1,594 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/burningalchemist/sql_exporter/config"
+	sqlerrors "github.com/burningalchemist/sql_exporter/errors"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNullableDest(t *testing.T) {
+	t.Run("NullableString", func(t *testing.T) {
+		s := "x"
+		dest := wrapNullable(new(sql.NullString), "Nullable(String)")
+		if err := dest.(sql.Scanner).Scan(&s); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+		if got := *unwrapNullable(dest).(*sql.NullString); got != (sql.NullString{String: "x", Valid: true}) {
+			t.Fatalf("expected valid %q but got: %+v", s, got)
+		}
+	})
+
+	t.Run("NullableFloatNull", func(t *testing.T) {
+		dest := wrapNullable(new(sql.NullFloat64), "Nullable(Float64)")
+		if err := dest.(sql.Scanner).Scan((*float64)(nil)); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+		if got := *unwrapNullable(dest).(*sql.NullFloat64); got.Valid {
+			t.Fatalf("expected NULL but got: %+v", got)
+		}
+	})
+
+	t.Run("LowCardinalityString", func(t *testing.T) {
+		dest := wrapNullable(new(sql.NullString), "LowCardinality(String)")
+		if err := dest.(sql.Scanner).Scan("y"); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+		if got := *unwrapNullable(dest).(*sql.NullString); got != (sql.NullString{String: "y", Valid: true}) {
+			t.Fatalf("expected valid %q but got: %+v", "y", got)
+		}
+	})
+
+	t.Run("OtherType", func(t *testing.T) {
+		dest := new(sql.NullString)
+		if got := wrapNullable(dest, "String"); got != dest {
+			t.Fatalf("expected destination to be returned as is but got: %#v", got)
+		}
+	})
+}
+
+func TestUUIDString(t *testing.T) {
+	raw := []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+	for _, src := range []any{raw, "123e4567-e89b-12d3-a456-426614174000"} {
+		var s uuidString
+		if err := s.Scan(src); err != nil {
+			t.Fatalf("expected no error but got: %v", err)
+		}
+		if s.String != "123e4567-e89b-12d3-a456-426614174000" || !s.Valid {
+			t.Fatalf("expected canonical UUID for %v but got: %+v", src, s.NullString)
+		}
+	}
+}
+
+func TestNormalizeMoney(t *testing.T) {
+	for _, tc := range []struct {
+		value, thousands, decimal, want string
+	}{
+		{"$1,234.56", ",", ".", "1234.56"},
+		{"(1.234,56 €)", ".", ",", "-1234.56"},
+		{"1\u00a0234,5 €", ".", ",", "1234.5"},
+	} {
+		if got := normalizeMoney(tc.value, tc.thousands, tc.decimal); got != tc.want {
+			t.Errorf("expected %q for %q but got: %q", tc.want, tc.value, got)
+		}
+	}
+}
+
+func TestParseTimestampFraction(t *testing.T) {
+	want := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	for _, s := range []string{
+		"2024-05-06 07:08:09 UTC",
+		"2024-05-06 07:08:09.000 UTC",
+		"2024-05-06 07:08:09.000000 UTC",
+		"2024-05-06 07:08:09.000000000 UTC",
+	} {
+		got, err := parseTimestamp(s, "trino", time.UTC)
+		if err != nil {
+			t.Fatalf("expected no error for %q but got: %v", s, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("expected %v for %q but got: %v", want, s, got)
+		}
+	}
+	if got := flexibleFraction("02.01.2006 15:04:05,000"); got != "02.01.2006 15:04:05,999" {
+		t.Errorf("expected only the fractional seconds to be rewritten but got: %q", got)
+	}
+}
+
+func TestFilterNumericValues(t *testing.T) {
+	value := sql.NullFloat64{Float64: 1e8, Valid: true}
+	if s, _ := filterValueString(value); s != "100000000" {
+		t.Errorf("expected plain decimal notation but got: %q", s)
+	}
+	zero := sql.NullFloat64{Valid: true}
+	for _, operand := range []string{"0", "0.0", " 0 "} {
+		if !filterEquals(zero, "0", operand) {
+			t.Errorf("expected 0 to equal %q", operand)
+		}
+	}
+	if filterEquals(zero, "0", "zero") {
+		t.Error("expected 0 not to equal a non-numeric operand")
+	}
+}
+
+func TestParseComposite(t *testing.T) {
+	got, err := parseComposite(`(42,"eu ""west""",,"",a\,b)`)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	want := []sql.NullString{
+		{String: "42", Valid: true},
+		{String: `eu "west"`, Valid: true},
+		{},
+		{String: "", Valid: true},
+		{String: "a,b", Valid: true},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v but got: %v", want, got)
+	}
+	for _, s := range []string{"42,a", `(1,"a)`} {
+		if _, err := parseComposite(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want float64
+	}{
+		{"12:34:56", 45296},
+		{"-838:59:59", -3020399},
+		{"00:00:01.5", 1.5},
+		{"1 day 02:00:00", 93600},
+		{"1 year 2 mons", 36741600},
+		{"-1 days +02:03:00", -79020},
+		{"3 mins", 180},
+		{"42", 42},
+		{"PT1M30S", 90},
+	} {
+		got, err := parseInterval(tc.s)
+		if err != nil {
+			t.Fatalf("expected no error for %q but got: %v", tc.s, err)
+		}
+		if got != tc.want {
+			t.Errorf("expected %v for %q but got: %v", tc.want, tc.s, got)
+		}
+	}
+	for _, s := range []string{"", "1:2:3:4", "3 parsecs", "12:3.5:00"} {
+		if _, err := parseInterval(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestDeltaTracker(t *testing.T) {
+	type observation struct {
+		key   string
+		value float64
+		want  float64
+		ok    bool
+	}
+	d := newDeltaTracker()
+	for i, scrape := range [][]observation{
+		{{"a", 10, 0, false}, {"b", 5, 0, false}},
+		{{"a", 15, 5, true}, {"b", 5, 0, true}},
+		// Counter reset of a, b not seen and pruned
+		{{"a", 3, 3, true}},
+		{{"a", 4, 1, true}, {"b", 7, 0, false}},
+	} {
+		d.begin()
+		for _, o := range scrape {
+			got, ok := d.delta(o.key, o.value)
+			if got != o.want || ok != o.ok {
+				t.Errorf("scrape %d: expected delta=%v ok=%t for %q but got delta=%v ok=%t", i, o.want, o.ok, o.key, got, ok)
+			}
+		}
+		d.prune()
+		if len(d.previous) != len(scrape) {
+			t.Errorf("scrape %d: expected %d tracked series after pruning but have %d", i, len(scrape), len(d.previous))
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want float64
+	}{
+		{"P1DT2H30M", 95400},
+		{"PT0.5S", 0.5},
+		{"-PT1M", -60},
+		{"P1Y2M", 36720000},
+		{"P2W", 1209600},
+		{"1h30m", 5400},
+		{" 90s ", 90},
+		{"-1.5s", -1.5},
+	} {
+		got, err := parseDuration(tc.s)
+		if err != nil {
+			t.Fatalf("expected no error for %q but got: %v", tc.s, err)
+		}
+		if got != tc.want {
+			t.Errorf("expected %v for %q but got: %v", tc.want, tc.s, got)
+		}
+	}
+	for _, s := range []string{"", "P", "-P", "PT", "P1DT", "P1.2.3D", "5 parsecs"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+// testDriver is a driver.Connector answering queries with the result configured for their SQL text, or an error.
+type testDriver struct {
+	mu       sync.Mutex
+	results  map[string]testResult
+	failures map[string][]error
+}
+
+type testResult struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// set configures the result of query, replacing any previous one.
+func (d *testDriver) set(query string, columns []string, rows ...[]driver.Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.results == nil {
+		d.results = make(map[string]testResult)
+	}
+	d.results[query] = testResult{columns: columns, rows: rows}
+}
+
+// unset removes the result of query, so that running it fails.
+func (d *testDriver) unset(query string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.results, query)
+}
+
+// failNext has the next runs of query fail with errs, one after the other.
+func (d *testDriver) failNext(query string, errs ...error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failures == nil {
+		d.failures = make(map[string][]error)
+	}
+	d.failures[query] = append(d.failures[query], errs...)
+}
+
+func (d *testDriver) Connect(context.Context) (driver.Conn, error) { return testConn{d}, nil }
+func (d *testDriver) Driver() driver.Driver                        { return nil }
+
+type testConn struct{ d *testDriver }
+
+func (c testConn) Prepare(query string) (driver.Stmt, error) { return testStmt{c.d, query}, nil }
+func (c testConn) Close() error                              { return nil }
+func (c testConn) Begin() (driver.Tx, error)                 { return nil, errors.New("transactions not supported") }
+
+type testStmt struct {
+	d     *testDriver
+	query string
+}
+
+func (s testStmt) Close() error  { return nil }
+func (s testStmt) NumInput() int { return -1 }
+func (s testStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+func (s testStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if errs := s.d.failures[s.query]; len(errs) > 0 {
+		s.d.failures[s.query] = errs[1:]
+		return nil, errs[0]
+	}
+	result, found := s.d.results[s.query]
+	if !found {
+		return nil, fmt.Errorf("unknown query %q", s.query)
+	}
+	return &testRows{testResult: result}, nil
+}
+
+type testRows struct {
+	testResult
+	next int
+}
+
+func (r *testRows) Columns() []string { return r.columns }
+func (r *testRows) Close() error      { return nil }
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.next == len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// testQueries returns the queries of the collector configured by the YAML.
+func testQueries(t *testing.T, collectorYAML string) []*Query {
+	t.Helper()
+	var cc config.CollectorConfig
+	if err := yaml.Unmarshal([]byte(collectorYAML), &cc); err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	c, err := NewCollector("", &cc, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	return c.(*collector).queries
+}
+
+func TestScanRowLenientFailure(t *testing.T) {
+	q := testQueries(t, `
+collector_name: c
+metrics:
+  - metric_name: m
+    type: gauge
+    help: h
+    key_labels: [k]
+    values: [v]
+    query_ref: q
+queries:
+  - query_name: q
+    query: SELECT k, v FROM t
+    lenient_scan: true
+`)[0]
+	d := &testDriver{}
+	d.set("SELECT k, v FROM t", []string{"k", "v"}, []driver.Value{"a", 1.0}, []driver.Value{"b", 2.0})
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	rows, err := db.Query("SELECT k, v FROM t")
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("expected no error but got: %v", err)
+	}
+	dest, werr := q.scanDest(rows)
+	if werr != nil {
+		t.Fatalf("expected no error but got: %v", werr)
+	}
+	if !rows.Next() {
+		t.Fatalf("expected a first row")
+	}
+	row, werr := q.scanRow(rows, dest)
+	if werr != nil {
+		t.Fatalf("expected no error but got: %v", werr)
+	}
+	if got := row["v"]; got != (sql.NullFloat64{Float64: 1, Valid: true}) {
+		t.Fatalf("expected the value of the first row but got: %v", got)
+	}
+
+	// The second row can't be read anymore: it must fail rather than leave the first row's values in dest.
+	if !rows.Next() {
+		t.Fatalf("expected a second row")
+	}
+	rows.Close()
+	if err := q.scanColumns(rows, columns, dest); err == nil {
+		t.Fatalf("expected an error scanning a closed row but got none")
+	}
+	if row, werr := q.scanRow(rows, dest); werr == nil {
+		t.Fatalf("expected an error but got row: %v", row)
+	}
+}
+
+// testCollect runs the query once and returns the values of the metrics it collected, by their label values, along
+// with the number of errors.
+func testCollect(t *testing.T, q *Query, db *sql.DB) (map[string]float64, int) {
+	t.Helper()
+	ch := make(chan Metric, 100)
+	q.Collect(context.Background(), db, ch)
+	close(ch)
+	values := make(map[string]float64)
+	errs := 0
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			errs++
+			continue
+		}
+		var labels []string
+		for _, lp := range pb.Label {
+			labels = append(labels, lp.GetName()+"="+lp.GetValue())
+		}
+		values[strings.Join(labels, ",")] = pb.GetGauge().GetValue()
+	}
+	return values, errs
+}
+
+func TestDeltasWithSchemas(t *testing.T) {
+	q := testQueries(t, `
+collector_name: c
+metrics:
+  - metric_name: m
+    type: gauge
+    help: h
+    values: [dv]
+    deltas:
+      - source_column: v
+        output_column: dv
+    query_ref: q
+queries:
+  - query_name: q
+    query: SELECT v FROM {{schema}}.t
+    schemas:
+      names: [a, b]
+`)[0]
+	d := &testDriver{}
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	for i, scrape := range []struct {
+		a, b float64
+		want map[string]float64
+	}{
+		{10, 100, map[string]float64{}},
+		{15, 130, map[string]float64{"schema=a": 5, "schema=b": 30}},
+		{16, 131, map[string]float64{"schema=a": 1, "schema=b": 1}},
+	} {
+		d.set("SELECT v FROM a.t", []string{"v"}, []driver.Value{scrape.a})
+		d.set("SELECT v FROM b.t", []string{"v"}, []driver.Value{scrape.b})
+		got, errs := testCollect(t, q, db)
+		if errs != 0 {
+			t.Fatalf("scrape %d: expected no errors but got %d", i, errs)
+		}
+		if !maps.Equal(got, scrape.want) {
+			t.Errorf("scrape %d: expected %v but got: %v", i, scrape.want, got)
+		}
+	}
+}
+
+func TestDeltasAfterFailure(t *testing.T) {
+	q := testQueries(t, `
+collector_name: c
+metrics:
+  - metric_name: m
+    type: gauge
+    help: h
+    key_labels: [k]
+    values: [dv]
+    deltas:
+      - source_column: v
+        output_column: dv
+    query_ref: q
+queries:
+  - query_name: q
+    query: SELECT k, v FROM t
+`)[0]
+	d := &testDriver{}
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	for i, scrape := range []struct {
+		rows [][]driver.Value // nil for a failed query
+		want map[string]float64
+		errs int
+	}{
+		{[][]driver.Value{{"a", 10.0}, {"b", 20.0}}, map[string]float64{}, 0},
+		{nil, map[string]float64{}, 1},
+		{[][]driver.Value{{"a", 15.0}, {"b", 21.0}}, map[string]float64{"k=a": 5, "k=b": 1}, 0},
+		// b is gone, and forgotten
+		{[][]driver.Value{{"a", 16.0}}, map[string]float64{"k=a": 1}, 0},
+		{[][]driver.Value{{"a", 17.0}, {"b", 30.0}}, map[string]float64{"k=a": 1}, 0},
+	} {
+		if scrape.rows == nil {
+			d.unset("SELECT k, v FROM t")
+		} else {
+			d.set("SELECT k, v FROM t", []string{"k", "v"}, scrape.rows...)
+		}
+		got, errs := testCollect(t, q, db)
+		if errs != scrape.errs {
+			t.Fatalf("scrape %d: expected %d errors but got %d", i, scrape.errs, errs)
+		}
+		if !maps.Equal(got, scrape.want) {
+			t.Errorf("scrape %d: expected %v but got: %v", i, scrape.want, got)
+		}
+	}
+}
+
+func TestTimeParamsConcurrentScrapes(t *testing.T) {
+	q := testQueries(t, `
+collector_name: c
+metrics:
+  - metric_name: m
+    type: gauge
+    help: h
+    values: [v]
+    query_ref: q
+queries:
+  - query_name: q
+    query: SELECT v FROM t WHERE ts > ?
+    time_params: [interval_start]
+`)[0]
+	d := &testDriver{}
+	d.set("SELECT v FROM t WHERE ts > ?", []string{"v"}, []driver.Value{1.0})
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	// Meant to be run with -race: concurrent scrapes (e.g. by two Prometheus servers) share the previous scrape time.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan Metric, 10)
+			q.Collect(context.Background(), db, ch)
+		}()
+	}
+	wg.Wait()
+	if q.lastScrape.IsZero() {
+		t.Errorf("expected the scrape time to be recorded")
+	}
+}
+
+func TestTransientErrorRetries(t *testing.T) {
+	q := testQueries(t, `
+collector_name: c
+metrics:
+  - metric_name: m
+    type: gauge
+    help: h
+    values: [v]
+    query_ref: q
+queries:
+  - query_name: q
+    query: SELECT v FROM t
+    retries: 2
+`)[0]
+	d := &testDriver{}
+	d.set("SELECT v FROM t", []string{"v"}, []driver.Value{1.0})
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	d.failNext("SELECT v FROM t", sqlStateError("40P01"), sqlStateError("40P01"))
+	start := time.Now()
+	got, errs := testCollect(t, q, db)
+	if errs != 0 || !maps.Equal(got, map[string]float64{"": 1}) {
+		t.Fatalf("expected the value after retrying but got %v with %d errors", got, errs)
+	}
+	if elapsed := time.Since(start); elapsed < 3*transientRetryDelay {
+		t.Errorf("expected retries to back off for at least %v but took: %v", 3*transientRetryDelay, elapsed)
+	}
+
+	// Backing off stops at the scrape deadline.
+	d.failNext("SELECT v FROM t", sqlStateError("40P01"), sqlStateError("40P01"))
+	ctx, cancel := context.WithTimeout(context.Background(), transientRetryDelay/5)
+	defer cancel()
+	ch := make(chan Metric, 10)
+	start = time.Now()
+	q.Collect(ctx, db, ch)
+	if elapsed := time.Since(start); elapsed >= transientRetryDelay {
+		t.Errorf("expected the retries to stop at the deadline but took: %v", elapsed)
+	}
+	close(ch)
+	var werr sqlerrors.WithContext
+	for m := range ch {
+		if werr = m.Write(&dto.Metric{}); werr != nil {
+			break
+		}
+	}
+	if werr == nil || !errors.Is(werr, context.DeadlineExceeded) {
+		t.Errorf("expected err=%q but got err=%v", context.DeadlineExceeded, werr)
+	}
+}
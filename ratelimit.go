@@ -0,0 +1,100 @@
+package sql_exporter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the rate of query executions, allowing bursts of up to one second worth of
+// queries.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // maximum number of tokens
+
+	mu     sync.Mutex
+	tokens float64 // available tokens, negative when queries are waiting for them
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing qps queries per second, or nil if qps isn't positive.
+func newRateLimiter(qps float64) *rateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	burst := math.Max(1, math.Ceil(qps))
+	return &rateLimiter{rate: qps, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// release gives back a reserved token which won't be used.
+func (l *rateLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+1)
+}
+
+// wait blocks until a token is available or ctx is done, and returns how long it was (or would have been) blocked.
+// It returns early if ctx would expire before the token is available.
+func (l *rateLimiter) wait(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	delay := l.reserve(now)
+	if delay == 0 {
+		return 0, nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(delay)) {
+		l.release()
+		return delay, context.DeadlineExceeded
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		l.release()
+		return delay, ctx.Err()
+	}
+}
+
+// rateLimitersKey is the context key of the rate limiters applying to the queries of a scrape.
+type rateLimitersKey struct{}
+
+// withRateLimiter returns a copy of ctx carrying the rate limiter, in addition to those ctx already carries. A nil
+// limiter is ignored.
+func withRateLimiter(ctx context.Context, l *rateLimiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	limiters, _ := ctx.Value(rateLimitersKey{}).([]*rateLimiter)
+	return context.WithValue(ctx, rateLimitersKey{}, append(limiters[:len(limiters):len(limiters)], l))
+}
+
+// waitRateLimits waits for all the rate limiters carried by ctx to allow a query, and returns how long that took.
+func waitRateLimits(ctx context.Context) (time.Duration, error) {
+	limiters, _ := ctx.Value(rateLimitersKey{}).([]*rateLimiter)
+	var waited time.Duration
+	for _, l := range limiters {
+		delay, err := l.wait(ctx)
+		waited += delay
+		if err != nil {
+			return waited, err
+		}
+	}
+	return waited, nil
+}
@@ -0,0 +1,69 @@
+package sql_exporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	if l := newRateLimiter(0); l != nil {
+		t.Fatalf("expected no rate limiter for 0 qps but got: %+v", l)
+	}
+
+	l := newRateLimiter(2)
+	now := l.last
+	for i, tc := range []struct {
+		advance time.Duration
+		release bool
+		want    time.Duration
+	}{
+		{0, false, 0},
+		{0, false, 0},
+		{0, false, 500 * time.Millisecond},
+		{0, false, time.Second},
+		{0, true, time.Second},
+		{time.Second, false, 500 * time.Millisecond},
+		{10 * time.Second, false, 0},
+	} {
+		if tc.release {
+			l.release()
+		}
+		now = now.Add(tc.advance)
+		if got := l.reserve(now); got != tc.want {
+			t.Errorf("step %d: expected a delay of %v but got: %v", i, tc.want, got)
+		}
+	}
+	if l.tokens != 1 {
+		t.Errorf("expected the bucket to be capped to its burst, leaving 1 token but got: %v", l.tokens)
+	}
+}
+
+func TestRateLimiterWaitDeadline(t *testing.T) {
+	l := newRateLimiter(1)
+	if delay, err := l.wait(context.Background()); delay != 0 || err != nil {
+		t.Fatalf("expected the first token without waiting but got delay=%v err=%v", delay, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	delay, err := l.wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected err=%q but got err=%v", context.DeadlineExceeded, err)
+	}
+	if delay < 900*time.Millisecond {
+		t.Errorf("expected the would-be delay of about 1s but got: %v", delay)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected wait to return before the deadline but it took: %v", elapsed)
+	}
+	if l.tokens < -0.5 {
+		t.Errorf("expected the reserved token to be released but have %v tokens", l.tokens)
+	}
+
+	if waited, err := waitRateLimits(withRateLimiter(context.Background(), nil)); waited != 0 || err != nil {
+		t.Errorf("expected no wait without rate limiters but got waited=%v err=%v", waited, err)
+	}
+}
@@ -0,0 +1,114 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+
+	"github.com/burningalchemist/sql_exporter/errors"
+)
+
+// Schema names are spliced into the SQL of queries with schemas, so only plain identifiers are accepted.
+var schemaName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// collectSchemas runs the query once per schema. Errors of a schema are only recorded in the error metrics (and the
+// log), so the other schemas still produce metrics, unless the query failed in all of them.
+func (q *Query) collectSchemas(ctx context.Context, conn *sql.DB, ch chan<- Metric, args []any) {
+	schemas, err := q.schemaNames(ctx, conn)
+	if err != nil {
+		ch <- NewInvalidMetric(err)
+		return
+	}
+	if len(schemas) == 0 {
+		q.logger.Debug("No schemas to run the query in, skipping query", "logContext", q.logContext)
+		return
+	}
+
+	failed := 0
+	for _, schema := range schemas {
+		if ctx.Err() != nil {
+			ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
+			return
+		}
+		if !q.collectSchema(ctx, conn, ch, schema, args) {
+			failed++
+		}
+	}
+	if failed == len(schemas) {
+		ch <- NewInvalidMetric(errors.Categorize(errors.Errorf(q.logContext, "query failed in all %d schemas", failed),
+			errors.CategoryQuery))
+	}
+}
+
+// collectSchema runs the query in a schema, only recording its errors, and returns whether it succeeded.
+func (q *Query) collectSchema(ctx context.Context, conn *sql.DB, ch chan<- Metric, schema string, args []any) bool {
+	ok := true
+	schemaCh, done := dropErrors(ch, func(err errors.WithContext) {
+		ok = false
+		if q.deltas != nil {
+			q.deltas.fail()
+		}
+		q.logger.Warn("Query failed in schema, carrying on with the other schemas", "logContext", q.logContext,
+			"schema", schema, "error", err)
+	})
+	q.collect(ctx, conn, schemaCh, schema, args...)
+	done()
+	return ok
+}
+
+// schemaNames returns the schemas to run the query in, listed in the config or returned by the discovery query. Names
+// which aren't plain identifiers are skipped.
+func (q *Query) schemaNames(ctx context.Context, conn *sql.DB) (_ []string, werr errors.WithContext) {
+	defer func() { werr = errors.Categorize(werr, errors.CategoryQuery) }()
+
+	s := q.config.Schemas
+	names := s.Names
+	if s.Query != "" {
+		if err := q.rateLimit(ctx); err != nil {
+			return nil, err
+		}
+		rows, err := conn.QueryContext(ctx, s.Query)
+		if err != nil {
+			return nil, errors.Wrapf(q.logContext, err, "schemas query failed")
+		}
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		if err != nil {
+			return nil, errors.Wrap(q.logContext, err)
+		}
+		if len(columns) == 0 {
+			return nil, errors.New(q.logContext, "schemas query returned no columns")
+		}
+		dest := make([]any, len(columns))
+		dest[0] = new(sql.NullString)
+		for i := 1; i < len(dest); i++ {
+			dest[i] = new(any)
+		}
+		names = nil
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				return nil, errors.Wrapf(q.logContext, err, "scanning of schemas query failed")
+			}
+			if v := dest[0].(*sql.NullString); v.Valid {
+				names = append(names, v.String)
+			}
+			if len(names) > s.MaxSchemas {
+				return nil, errors.Errorf(q.logContext, "schemas query returned more than %d schemas", s.MaxSchemas)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, errors.Wrap(q.logContext, err)
+		}
+	}
+
+	valid := make([]string, 0, len(names))
+	for _, name := range names {
+		if !schemaName.MatchString(name) {
+			q.logger.Warn("Skipping schema whose name is not a plain identifier", "logContext", q.logContext, "schema", name)
+			continue
+		}
+		valid = append(valid, name)
+	}
+	return valid, nil
+}
@@ -3,19 +3,65 @@ package sql_exporter
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/xo/dburl"
 )
 
+// redactedPassword replaces passwords in data source names meant for logging.
+const redactedPassword = "xxxxx"
+
+// ConnectionOptions defines how OpenConnection opens a DB handle and its connections.
+type ConnectionOptions struct {
+	MaxConns        int           // maximum number of open connections
+	MaxIdleConns    int           // maximum number of idle connections
+	MaxConnLifetime time.Duration // maximum amount of time a connection may be reused, infinite if 0
+	MaxConnIdleTime time.Duration // maximum amount of time a connection may be idle, infinite if 0
+
+	// Password new connections authenticate with instead of the one in the DSN, if not nil.
+	PasswordProvider PasswordProvider
+	// Request compressed responses, for drivers supporting it.
+	Compression bool
+	// Statements that must succeed on each new connection, before it's used by queries.
+	InitSQL []string
+	// Statements executed on each new connection, after InitSQL.
+	SessionSettings []string
+	// Application name added to the DSN in the parameter the driver reports to the database, if not empty.
+	ApplicationName string
+	// Connection attributes added to the DSN, for drivers supporting them.
+	ConnAttributes map[string]string
+	// Ping pooled connections before reuse, discarding broken ones.
+	ValidateConns bool
+	// Have drivers supporting it cache the statements they parse on each connection, even for queries that aren't
+	// prepared.
+	StatementCache bool
+}
+
+// ConnectionCounters are the (optional) counters OpenConnection accounts connection events in.
+type ConnectionCounters struct {
+	Transferred  prometheus.Counter // bytes received with compression
+	InitFailures prometheus.Counter // failures of init statements
+	Stale        prometheus.Counter // pooled connections discarded by validation
+}
+
 // OpenConnection parses a provided DSN, and opens a DB handle ensuring early termination if the context is closed
-// (this is actually prevented by `database/sql` implementation), sets connection limits and returns the handle.
-func OpenConnection(ctx context.Context, logContext, dsn string, maxConns, maxIdleConns int, maxConnLifetime time.Duration) (*sql.DB, error) {
+// (this is actually prevented by `database/sql` implementation), sets connection limits and returns the handle,
+// configured as per opts. Connection events are counted in the non-nil counters.
+func OpenConnection(
+	ctx context.Context, logContext, dsn string, opts ConnectionOptions, counters ConnectionCounters,
+) (*sql.DB, error) {
 	var (
 		url  *dburl.URL
 		conn *sql.DB
@@ -32,10 +78,54 @@ func OpenConnection(ctx context.Context, logContext, dsn string, maxConns, maxId
 	if url.GoDriver != "" {
 		driver = url.GoDriver
 	}
+	slog.Debug("Parsed data source name", "logContext", logContext, "dsn", redactURL(url).String(), "host", url.Hostname(),
+		"port", url.Port(), "database", strings.TrimPrefix(url.Path, "/"))
+
+	if opts.Compression {
+		if url, err = enableCompression(logContext, driver, url, counters.Transferred); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ApplicationName != "" {
+		if url, err = setApplicationName(logContext, driver, url, opts.ApplicationName); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.ConnAttributes) > 0 {
+		if url, err = setConnectionAttributes(logContext, driver, url, opts.ConnAttributes); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.StatementCache {
+		if url, err = enableStatementCache(logContext, driver, url); err != nil {
+			return nil, err
+		}
+	}
 
 	// Open the DB handle in a separate goroutine so we can terminate early if the context closes.
 	go func() {
-		conn, err = sql.Open(driver, url.DSN)
+		switch {
+		case len(opts.InitSQL) > 0 || len(opts.SessionSettings) > 0 || opts.ValidateConns:
+			var (
+				session   *sessionConnector
+				validator *validatingConnector
+			)
+			if len(opts.InitSQL) > 0 || len(opts.SessionSettings) > 0 {
+				session = &sessionConnector{initSQL: opts.InitSQL, settings: opts.SessionSettings,
+					initFailures: counters.InitFailures}
+			}
+			if opts.ValidateConns {
+				validator = &validatingConnector{logContext: logContext, stale: counters.Stale}
+			}
+			conn, err = openWithConnector(driver, url, opts.PasswordProvider, session, validator)
+		case opts.PasswordProvider != nil:
+			conn, err = openWithPasswordProvider(driver, url, opts.PasswordProvider)
+		default:
+			conn, err = sql.Open(driver, url.DSN)
+		}
 		close(ch)
 	}()
 
@@ -48,14 +138,238 @@ func OpenConnection(ctx context.Context, logContext, dsn string, maxConns, maxId
 		}
 	}
 
-	conn.SetMaxIdleConns(maxIdleConns)
-	conn.SetMaxOpenConns(maxConns)
-	conn.SetConnMaxLifetime(maxConnLifetime)
+	conn.SetMaxIdleConns(opts.MaxIdleConns)
+	conn.SetMaxOpenConns(opts.MaxConns)
+	conn.SetConnMaxLifetime(opts.MaxConnLifetime)
+	conn.SetConnMaxIdleTime(opts.MaxConnIdleTime)
 
 	slog.Debug("Database handle successfully opened", "logContext", logContext, "driver", driver)
 	return conn, nil
 }
 
+// applicationNameParams maps driver names to the DSN parameter reporting the application name to the database.
+var applicationNameParams = map[string]string{
+	"postgres":  "application_name",
+	"pgx":       "application_name",
+	"sqlserver": "app name",
+	"snowflake": "application",
+	"trino":     "source",
+}
+
+// setApplicationName returns the data source name amended with the application name, unless the DSN already sets it.
+func setApplicationName(logContext, driverName string, u *dburl.URL, name string) (*dburl.URL, error) {
+	query := u.Query()
+	switch param, ok := applicationNameParams[driverName]; {
+	case driverName == "mysql":
+		// MySQL only takes it as a connection attribute, on top of any others already set.
+		attrs := query.Get("connectionAttributes")
+		if strings.Contains(attrs, "program_name:") {
+			return u, nil
+		}
+		if attrs != "" {
+			attrs += ","
+		}
+		query.Set("connectionAttributes", attrs+"program_name:"+name)
+	case !ok:
+		slog.Warn("Application name is not supported by the driver, consider session_settings instead", "logContext", logContext,
+			"driver", driverName)
+		return u, nil
+	case query.Has(param):
+		return u, nil
+	default:
+		query.Set(param, name)
+	}
+
+	// Regenerate the driver DSN from the amended URL, the parameters are passed through to the driver.
+	amended := u.URL
+	amended.RawQuery = query.Encode()
+	return reparse(amended)
+}
+
+// checkConnectionAttributes checks the connection attributes of a target are supported by its driver and can be
+// encoded for it.
+func checkConnectionAttributes(driverName string, attrs map[string]string) error {
+	if driverName != "mysql" {
+		return fmt.Errorf("connection_attributes are not supported by driver %q, consider application_name instead", driverName)
+	}
+	for name, value := range attrs {
+		// MySQL connection attributes are a list of name:value pairs, without any escaping.
+		if name == "" || strings.ContainsAny(name, ",:") || strings.ContainsAny(value, ",:") {
+			return fmt.Errorf("invalid connection attribute %q: %q, names must be non-empty and neither may contain ',' or ':'",
+				name, value)
+		}
+	}
+	return nil
+}
+
+// setConnectionAttributes returns the data source name amended with the connection attributes, on top of any others
+// already set, those already set (e.g. program_name by the application name) taking precedence.
+func setConnectionAttributes(logContext, driverName string, u *dburl.URL, attrs map[string]string) (*dburl.URL, error) {
+	if err := checkConnectionAttributes(driverName, attrs); err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	existing := query.Get("connectionAttributes")
+	set := make(map[string]bool)
+	for _, attr := range strings.Split(existing, ",") {
+		if name, _, found := strings.Cut(attr, ":"); found {
+			set[name] = true
+		}
+	}
+	pairs := make([]string, 0, len(attrs)+1)
+	if existing != "" {
+		pairs = append(pairs, existing)
+	}
+	for _, name := range slices.Sorted(maps.Keys(attrs)) {
+		if !set[name] {
+			pairs = append(pairs, name+":"+attrs[name])
+		}
+	}
+	query.Set("connectionAttributes", strings.Join(pairs, ","))
+	slog.Debug("Setting connection attributes", "logContext", logContext, "attributes", slices.Sorted(maps.Keys(attrs)))
+
+	amended := u.URL
+	amended.RawQuery = query.Encode()
+	return reparse(amended)
+}
+
+// statementCacheParams maps driver names to the DSN parameter and value having the driver cache the statements it
+// parses on each connection, so running the same (unprepared) SQL again skips parsing it server-side.
+var statementCacheParams = map[string][2]string{
+	"pgx": {"default_query_exec_mode", "cache_statement"},
+}
+
+// enableStatementCache returns the data source name amended to enable the statement cache of the driver, unless the
+// DSN already configures it.
+func enableStatementCache(logContext, driverName string, u *dburl.URL) (*dburl.URL, error) {
+	param, ok := statementCacheParams[driverName]
+	if !ok {
+		slog.Debug("Driver statement cache is not supported by the driver, statements are parsed on every execution",
+			"logContext", logContext, "driver", driverName)
+		return u, nil
+	}
+	query := u.Query()
+	if query.Has(param[0]) {
+		slog.Debug("Driver statement cache configured by the data source name", "logContext", logContext,
+			"driver", driverName, param[0], query.Get(param[0]))
+		return u, nil
+	}
+	query.Set(param[0], param[1])
+	slog.Debug("Driver statement cache active", "logContext", logContext, "driver", driverName, param[0], param[1])
+
+	amended := u.URL
+	amended.RawQuery = query.Encode()
+	return reparse(amended)
+}
+
+// openWithConnector opens a DB handle whose connections are initialized by the session connector when established, if
+// not nil, authenticating with passwords from the provider if not nil. Connections are validated before reuse by the
+// validator, if not nil.
+func openWithConnector(
+	driverName string, u *dburl.URL, pp PasswordProvider, session *sessionConnector, validator *validatingConnector,
+) (*sql.DB, error) {
+	// Opening a handle doesn't connect, it's only used to look up the registered driver.
+	db, err := sql.Open(driverName, u.DSN)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	var connector driver.Connector
+	switch dc, ok := drv.(driver.DriverContext); {
+	case pp != nil:
+		connector = &passwordConnector{driver: drv, url: u, provider: pp}
+	case ok:
+		if connector, err = dc.OpenConnector(u.DSN); err != nil {
+			return nil, err
+		}
+	default:
+		connector = &dsnConnector{driver: drv, dsn: u.DSN}
+	}
+	if session != nil {
+		session.Connector = connector
+		connector = session
+	}
+	if validator != nil {
+		validator.Connector = connector
+		connector = validator
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// dsnConnector implements driver.Connector for drivers not implementing driver.DriverContext.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+// Connect implements driver.Connector.
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+// Driver implements driver.Connector.
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sessionConnector wraps a driver.Connector, executing the init statements (e.g. `USE WAREHOUSE ...`) and session
+// settings (e.g. `SET search_path = ...`) on each new connection, so that all pooled connections share the same session
+// configuration.
+type sessionConnector struct {
+	driver.Connector
+	initSQL      []string
+	settings     []string
+	initFailures prometheus.Counter // counts failed init statements, if not nil
+}
+
+// Connect implements driver.Connector.
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range c.initSQL {
+		if err := execOnConn(ctx, conn, statement); err != nil {
+			conn.Close()
+			if c.initFailures != nil {
+				c.initFailures.Inc()
+			}
+			return nil, fmt.Errorf("init statement %q failed: %w", statement, err)
+		}
+	}
+	for _, setting := range c.settings {
+		if err := execOnConn(ctx, conn, setting); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("session setting %q failed: %w", setting, err)
+		}
+	}
+	return conn, nil
+}
+
+// execOnConn executes a statement without arguments on a driver connection.
+func execOnConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if sc, ok := stmt.(driver.StmtExecContext); ok {
+		_, err = sc.ExecContext(ctx, nil)
+	} else {
+		_, err = stmt.Exec(nil)
+	}
+	return err
+}
+
 // PingDB is a wrapper around sql.DB.PingContext() that terminates as soon as the context is closed.
 //
 // sql.DB does not actually pass along the context to the driver when opening a connection (which always happens if the
@@ -77,6 +391,36 @@ func PingDB(ctx context.Context, conn *sql.DB) error {
 	}
 }
 
+// IsTransientError reports whether a query error is likely to go away if the query is re-run, e.g. a deadlock, a
+// serialization failure or a connection reset underneath us.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	// PostgreSQL-compatible drivers expose the SQLSTATE code.
+	var sqlStateErr interface{ SQLState() string }
+	if errors.As(err, &sqlStateErr) {
+		state := sqlStateErr.SQLState()
+		// serialization_failure, deadlock_detected and connection exceptions (class 08).
+		return state == "40001" || state == "40P01" || strings.HasPrefix(state, "08")
+	}
+	// Microsoft SQL Server exposes its own error numbers.
+	var mssqlErr interface{ SQLErrorNumber() int32 }
+	if errors.As(err, &mssqlErr) {
+		// 1205: chosen as deadlock victim.
+		return mssqlErr.SQLErrorNumber() == 1205
+	}
+
+	// Fall back to the error message for drivers that expose neither (e.g. MySQL error 1213).
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "deadlock") || strings.Contains(msg, "connection reset")
+}
+
 // safeParse wraps dburl.Parse method in order to prevent leaking credentials
 // if underlying url parse failed. By default it returns a raw url string in error message,
 // which most likely contains a password. It's undesired here.
@@ -93,6 +437,84 @@ func safeParse(rawURL string) (*dburl.URL, error) {
 	return parsed, nil
 }
 
+// reparse parses a data source name amended from an already parsed one, without leaking credentials on error like
+// safeParse (but without expanding environment variables again).
+func reparse(amended url.URL) (*dburl.URL, error) {
+	parsed, err := dburl.Parse(amended.String())
+	if err != nil {
+		if uerr := new(url.Error); errors.As(err, &uerr) {
+			return nil, uerr.Err
+		}
+		return nil, errors.New("invalid URL")
+	}
+	return parsed, nil
+}
+
+// redactURL returns a copy of the parsed URL with the password (both in the userinfo and in well-known query
+// parameters) masked, so it can be logged safely.
+func redactURL(u *dburl.URL) *dburl.URL {
+	redacted := *u
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			redacted.User = url.UserPassword(u.User.Username(), redactedPassword)
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			switch strings.ToLower(key) {
+			case "password", "pass", "pwd", "token", "access_token":
+				query.Set(key, redactedPassword)
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return &redacted
+}
+
+// dsnInstance returns the host (and port, if any) of the provided DSN, or an empty string if it cannot be parsed.
+func dsnInstance(dsn string) string {
+	u, err := safeParse(dsn)
+	if err != nil {
+		return ""
+	}
+	if u.Host != "" {
+		return u.Host
+	}
+	return u.Opaque
+}
+
+// dsnDatabase returns the name of the database the data source name connects to, from its path or else a database
+// parameter (e.g. for SQL Server), or an empty string if none.
+func dsnDatabase(dsn string) string {
+	u, err := safeParse(dsn)
+	if err != nil {
+		return ""
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		return db
+	}
+	query := u.Query()
+	for _, param := range []string{"database", "dbname"} {
+		if db := query.Get(param); db != "" {
+			return db
+		}
+	}
+	return ""
+}
+
+// dsnDriver returns the name of the Go driver handling the data source name, or an empty string if it can't be parsed.
+func dsnDriver(dsn string) string {
+	u, err := safeParse(dsn)
+	if err != nil {
+		return ""
+	}
+	if u.GoDriver != "" {
+		return u.GoDriver
+	}
+	return u.Driver
+}
+
 // expandEnv falls back to the original env variable if not found for better readability
 func expandEnv(env string) string {
 	lookupFunc := func(env string) string {
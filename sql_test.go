@@ -0,0 +1,47 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+)
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sqlstate " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+type mssqlError int32
+
+func (e mssqlError) Error() string         { return fmt.Sprintf("mssql error %d", e) }
+func (e mssqlError) SQLErrorNumber() int32 { return int32(e) }
+
+func TestIsTransientError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{context.Canceled, false},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{sqlStateError("40001"), true},
+		{sqlStateError("40P01"), true},
+		{fmt.Errorf("exec: %w", sqlStateError("08006")), true},
+		{sqlStateError("42P01"), false},
+		{mssqlError(1205), true},
+		{mssqlError(208), false},
+		{errors.New("Error 1213 (40001): Deadlock found when trying to get lock"), true},
+		{errors.New("syntax error"), false},
+	} {
+		if got := IsTransientError(tc.err); got != tc.want {
+			t.Errorf("expected %t for %v but got: %t", tc.want, tc.err, got)
+		}
+	}
+}
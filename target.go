@@ -6,6 +6,8 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -47,14 +49,28 @@ type target struct {
 	scrapeDurationDesc MetricDesc
 	logContext         string
 	enablePing         *bool
+	connOptions        ConnectionOptions
+	scrapeBudget       time.Duration
+	keepGoing          bool
+	connections        map[string]string // additional data source names, by connection name
+	versionQuery       string            // query returning the database server version, if exported
+	versionCollected   bool              // whether the version of the current DB handle was queried
+	encryptionQuery    string            // query returning whether the connection is encrypted, if required
+	encryptionChecked  bool              // whether the current DB handle was found to be encrypted
+	rateLimiter        *rateLimiter      // limits the rate of query executions, if configured
 
 	conn *sql.DB
+	// Handles of the additional connections, by name, opened along with conn.
+	replicas map[string]*sql.DB
+	// openStart is when the DB handle was opened, until the first successful ping records the connection latency.
+	openStart time.Time
 }
 
 // NewTarget returns a new Target with the given target name, data source name, collectors and constant labels.
 // An empty target name means the exporter is running in single target mode: no synthetic metrics will be exported.
 func NewTarget(
-	logContext, tname, jg, dsn string, ccs []*config.CollectorConfig, constLabels prometheus.Labels, gc *config.GlobalConfig, ep *bool) (
+	logContext, tname, jg, dsn string, ccs []*config.CollectorConfig, constLabels prometheus.Labels, gc *config.GlobalConfig, ep *bool,
+	opts *config.TargetOptions) (
 	Target, errors.WithContext,
 ) {
 	if tname != "" {
@@ -64,11 +80,40 @@ func NewTarget(
 		}
 	}
 
+	if config.InstanceLabel != "" {
+		if instance := dsnInstance(dsn); instance != "" {
+			if constLabels == nil {
+				constLabels = prometheus.Labels{}
+			}
+			constLabels[config.InstanceLabel] = instance
+		} else {
+			slog.Warn("Unable to derive instance label from data source name", "logContext", logContext)
+		}
+	}
+
 	if ep == nil {
 		ep = &config.EnablePing
 	}
 	slog.Debug("target ping enabled", "logContext", logContext, "enabled", *ep)
 
+	if opts == nil {
+		opts = &config.TargetOptions{}
+	}
+	pp, err := NewPasswordProvider(opts)
+	if err != nil {
+		return nil, errors.Wrap(logContext, err)
+	}
+
+	// Target labels go beneath the labels of the job's static_config, which are more specific.
+	for name, value := range opts.Labels {
+		if constLabels == nil {
+			constLabels = prometheus.Labels{}
+		}
+		if _, found := constLabels[name]; !found {
+			constLabels[name] = value
+		}
+	}
+
 	// Sort const labels by name to ensure consistent ordering.
 	constLabelPairs := make([]*dto.LabelPair, 0, len(constLabels))
 	for n, v := range constLabels {
@@ -79,9 +124,63 @@ func NewTarget(
 	}
 	sort.Sort(labelPairSorter(constLabelPairs))
 
+	var connections map[string]string
+	for name, dsn := range opts.Connections {
+		if connections == nil {
+			connections = make(map[string]string, len(opts.Connections))
+		}
+		connections[name] = string(dsn)
+	}
+	for _, cc := range ccs {
+		for _, mc := range cc.Metrics {
+			if qc := mc.Query(); qc.Connection != "" && connections[qc.Connection] == "" {
+				return nil, errors.Errorf(logContext, "unknown connection %q for query %q of collector %q", qc.Connection,
+					qc.Name, cc.Name)
+			}
+			for _, l := range mc.KeyLabels {
+				if _, found := opts.Labels[l]; found {
+					return nil, errors.Errorf(logContext, "label %q is defined both by the target labels and by metric %q of collector %q",
+						l, mc.Name, cc.Name)
+				}
+			}
+		}
+	}
+
+	if opts.MaxQueriesPerSec < 0 {
+		return nil, errors.Errorf(logContext, "max_queries_per_second must not be negative, have %v", opts.MaxQueriesPerSec)
+	}
+
+	if len(opts.ConnAttributes) > 0 {
+		if err := checkConnectionAttributes(dsnDriver(dsn), opts.ConnAttributes); err != nil {
+			return nil, errors.Wrap(logContext, err)
+		}
+	}
+
+	var encryptionQuery string
+	if opts.RequireEncryption {
+		driverName := dsnDriver(dsn)
+		if encryptionQuery = encryptionQueries[driverName]; encryptionQuery == "" {
+			return nil, errors.Errorf(logContext, "require_encryption is not supported by driver %q", driverName)
+		}
+	}
+
+	versionQuery := opts.VersionQuery
+	if versionQuery == "" && config.DBVersionMetric {
+		driverName := dsnDriver(dsn)
+		if versionQuery = versionQueries[driverName]; versionQuery == "" {
+			slog.Warn("No built-in version query for the driver, consider version_query", "logContext", logContext,
+				"driver", driverName)
+		}
+	}
+
+	databases := map[string]string{"": dsnDatabase(dsn)}
+	for name, dsn := range connections {
+		databases[name] = dsnDatabase(dsn)
+	}
+
 	collectors := make([]Collector, 0, len(ccs))
 	for _, cc := range ccs {
-		c, err := NewCollector(logContext, cc, constLabelPairs)
+		c, err := NewCollector(logContext, cc, constLabelPairs, opts.QueryFilter, databases)
 		if err != nil {
 			return nil, err
 		}
@@ -101,6 +200,13 @@ func NewTarget(
 		scrapeDurationDesc: scrapeDurationDesc,
 		logContext:         logContext,
 		enablePing:         ep,
+		connOptions:        newConnectionOptions(gc, opts, pp),
+		scrapeBudget:       time.Duration(opts.ScrapeInterval),
+		keepGoing:          opts.KeepGoing,
+		connections:        connections,
+		versionQuery:       versionQuery,
+		encryptionQuery:    encryptionQuery,
+		rateLimiter:        newRateLimiter(opts.MaxQueriesPerSec),
 	}
 	return &t, nil
 }
@@ -117,6 +223,10 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric) {
 		ch <- NewInvalidMetric(errors.Wrap(t.logContext, err))
 		targetUp = false
 	}
+	// Without ping, the target is up without the database having been contacted.
+	if targetConnectedMetric != nil && *t.enablePing {
+		targetConnectedMetric.WithLabelValues(t.jobGroup, t.name).Set(boolToFloat64(targetUp))
+	}
 	if t.name != "" {
 		// Export the target's `up` metric as early as we know what it should be.
 		ch <- NewMetric(t.upDesc, boolToFloat64(targetUp))
@@ -125,17 +235,45 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric) {
 	var wg sync.WaitGroup
 	// Don't bother with the collectors if target is down.
 	if targetUp {
+		collectCtx := ctx
+		if t.scrapeBudget > 0 {
+			// Abort the remaining queries once the scrape interval is used up, rather than pile up scrapes.
+			var cancel context.CancelFunc
+			collectCtx, cancel = context.WithTimeout(ctx, t.scrapeBudget-time.Since(scrapeStart))
+			defer cancel()
+		}
+		if len(t.replicas) > 0 {
+			collectCtx = withConnections(collectCtx, t.replicas)
+		}
+		collectCtx = withRateLimiter(collectCtx, t.rateLimiter)
+		if t.versionQuery != "" && dbVersionInfoMetric != nil {
+			t.collectVersion(collectCtx)
+		}
+		collectorCh, done := ch, func() {}
+		if t.keepGoing {
+			collectorCh, done = dropErrors(ch, func(err errors.WithContext) {
+				slog.Warn("Query failed, carrying on with the scrape", "logContext", t.logContext, "error", err)
+			})
+		}
 		wg.Add(len(t.collectors))
 		for _, c := range t.collectors {
 			// If using a single DB connection, collectors will likely run sequentially anyway. But we might have more.
 			go func(collector Collector) {
 				defer wg.Done()
-				collector.Collect(ctx, t.conn, ch)
+				collector.Collect(collectCtx, t.conn, collectorCh)
 			}(c)
 		}
+		// Wait for all collectors (if any) to complete.
+		wg.Wait()
+		done()
+		if ctx.Err() == nil && collectCtx.Err() != nil {
+			slog.Warn("Scrape exceeded the scrape interval, aborted remaining queries", "logContext", t.logContext,
+				"scrape_interval", t.scrapeBudget)
+			if scrapeBudgetExceededMetric != nil {
+				scrapeBudgetExceededMetric.WithLabelValues(t.jobGroup, t.name).Inc()
+			}
+		}
 	}
-	// Wait for all collectors (if any) to complete.
-	wg.Wait()
 
 	if t.name != "" {
 		// And export a `scrape duration` metric once we're done scraping.
@@ -148,40 +286,153 @@ func (t *target) ping(ctx context.Context) errors.WithContext {
 	// We cannot do this only once at creation time because the sql.Open() documentation says it "may" open an actual
 	// connection, so it "may" actually fail to open a handle to a DB that's initially down.
 	if t.conn == nil {
-		conn, err := OpenConnection(ctx, t.logContext, t.dsn, t.globalConfig.MaxConns, t.globalConfig.MaxIdleConns, t.globalConfig.MaxConnLifetime)
+		openStart := time.Now()
+		conn, err := t.open(ctx, t.dsn)
 		if err != nil {
 			if err != ctx.Err() {
-				return errors.Wrap(t.logContext, err)
+				return errors.Categorize(errors.Wrap(t.logContext, err), errors.CategoryConnection)
 			}
 			// if err == ctx.Err() fall through
 		} else {
 			t.conn = conn
+			t.openStart = openStart
 		}
 	}
+	for name, dsn := range t.connections {
+		if t.replicas[name] != nil || ctx.Err() != nil {
+			continue
+		}
+		conn, err := t.open(ctx, dsn)
+		if err != nil {
+			if err != ctx.Err() {
+				return errors.Categorize(errors.Wrapf(t.logContext, err, "connection %q", name), errors.CategoryConnection)
+			}
+			continue
+		}
+		if t.replicas == nil {
+			t.replicas = make(map[string]*sql.DB, len(t.connections))
+		}
+		t.replicas[name] = conn
+	}
 
 	// If we have a handle and the context is not closed, test whether the database is up.
 	// FIXME: we ping the database during each request even with cacheCollector. It leads
 	// to additional charges for paid database services.
 	if t.conn != nil && ctx.Err() == nil && *t.enablePing {
-		var err error
-		// Ping up to max_connections + 1 times as long as the returned error is driver.ErrBadConn, to purge the connection
-		// pool of bad connections. This might happen if the previous scrape timed out and in-flight queries got canceled.
-		for i := 0; i <= t.globalConfig.MaxConns; i++ {
-			if err = PingDB(ctx, t.conn); err != driver.ErrBadConn {
-				break
-			}
+		if err := t.pingDB(ctx, t.conn); err != nil {
+			return errors.Categorize(errors.Wrap(t.logContext, err), errors.CategoryConnection)
 		}
-		if err != nil {
-			return errors.Wrap(t.logContext, err)
+		for name, conn := range t.replicas {
+			if err := t.pingDB(ctx, conn); err != nil {
+				return errors.Categorize(errors.Wrapf(t.logContext, err, "connection %q", name), errors.CategoryConnection)
+			}
 		}
 	}
 
 	if ctx.Err() != nil {
 		return errors.Wrap(t.logContext, ctx.Err())
 	}
+
+	// With encryption required, refuse to collect anything over a connection that isn't. The TLS settings come from the
+	// data source name, so they're the same for all connections of the handle and it's only checked once.
+	if t.conn != nil && t.encryptionQuery != "" && !t.encryptionChecked {
+		encrypted, err := t.checkEncryption(ctx)
+		if err != nil {
+			return errors.Categorize(errors.Wrapf(t.logContext, err, "unable to check connection encryption"),
+				errors.CategoryConnection)
+		}
+		if !encrypted {
+			return errors.Categorize(errors.New(t.logContext, "connection is not encrypted, but require_encryption is set"),
+				errors.CategoryConnection)
+		}
+		t.encryptionChecked = true
+	}
+
+	// Record how long it took from opening the handle to the first successful ping (or just opening, without ping).
+	if !t.openStart.IsZero() {
+		if connectionOpenMetric != nil {
+			connectionOpenMetric.WithLabelValues(t.jobGroup, t.name).Set(time.Since(t.openStart).Seconds())
+		}
+		t.openStart = time.Time{}
+	}
 	return nil
 }
 
+// close closes the target's DB handles, if open, returning the first error.
+func (t *target) close() error {
+	var err error
+	for _, conn := range append([]*sql.DB{t.conn}, slices.Collect(maps.Values(t.replicas))...) {
+		if conn == nil {
+			continue
+		}
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// open opens a DB handle to the given data source name, with the target's settings.
+func (t *target) open(ctx context.Context, dsn string) (*sql.DB, error) {
+	var counters ConnectionCounters
+	if t.connOptions.Compression && driverReceivedBytesMetric != nil {
+		counters.Transferred = driverReceivedBytesMetric.WithLabelValues(t.jobGroup, t.name)
+	}
+	if t.connOptions.ValidateConns && staleConnectionsMetric != nil {
+		counters.Stale = staleConnectionsMetric.WithLabelValues(t.jobGroup, t.name)
+	}
+	if len(t.connOptions.InitSQL) > 0 && initFailuresMetric != nil {
+		counters.InitFailures = initFailuresMetric.WithLabelValues(t.jobGroup, t.name)
+	}
+	return OpenConnection(ctx, t.logContext, dsn, t.connOptions, counters)
+}
+
+// newConnectionOptions returns the connection options of a target, from the global and target settings.
+func newConnectionOptions(gc *config.GlobalConfig, opts *config.TargetOptions, pp PasswordProvider) ConnectionOptions {
+	return ConnectionOptions{
+		MaxConns:         gc.MaxConns,
+		MaxIdleConns:     gc.MaxIdleConns,
+		MaxConnLifetime:  gc.MaxConnLifetime,
+		MaxConnIdleTime:  gc.MaxConnIdleTime,
+		PasswordProvider: pp,
+		Compression:      opts.Compression,
+		InitSQL:          opts.InitSQL,
+		SessionSettings:  opts.SessionSettings,
+		ApplicationName:  opts.ApplicationName,
+		ConnAttributes:   opts.ConnAttributes,
+		ValidateConns:    opts.ValidateConns,
+		StatementCache:   opts.StatementCache,
+	}
+}
+
+// pingDB pings the database, up to max_connections + 1 times as long as the returned error is driver.ErrBadConn, to
+// purge the connection pool of bad connections. This might happen if the previous scrape timed out and in-flight
+// queries got canceled.
+func (t *target) pingDB(ctx context.Context, conn *sql.DB) error {
+	var err error
+	for i := 0; i <= t.globalConfig.MaxConns; i++ {
+		if err = PingDB(ctx, conn); err != driver.ErrBadConn {
+			break
+		}
+	}
+	return err
+}
+
+// connectionsKey is the context key of the additional connections of the target being scraped.
+type connectionsKey struct{}
+
+// withConnections returns a copy of ctx carrying the additional connections of a target, by name, for queries routed
+// to them.
+func withConnections(ctx context.Context, conns map[string]*sql.DB) context.Context {
+	return context.WithValue(ctx, connectionsKey{}, conns)
+}
+
+// connectionFromContext returns the additional connection with the given name carried by ctx, or nil if none.
+func connectionFromContext(ctx context.Context, name string) *sql.DB {
+	conns, _ := ctx.Value(connectionsKey{}).(map[string]*sql.DB)
+	return conns[name]
+}
+
 // boolToFloat64 converts a boolean flag to a float64 value (0.0 or 1.0).
 func boolToFloat64(value bool) float64 {
 	if value {
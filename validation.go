@@ -0,0 +1,128 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Timeout of the ping validating a pooled connection before it's reused.
+const connValidationTimeout = 5 * time.Second
+
+// validatingConnector wraps a driver.Connector, validating pooled connections with a ping before they are reused, so
+// connections silently dropped by the server (or a firewall) are discarded rather than failing the next query.
+type validatingConnector struct {
+	driver.Connector
+	logContext string
+	stale      prometheus.Counter // counts discarded connections, if not nil
+}
+
+// Connect implements driver.Connector.
+func (c *validatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &validatingConn{Conn: conn, connector: c}, nil
+}
+
+// validatingConn wraps a driver.Conn, pinging it whenever database/sql resets its session before reuse. All the
+// optional interfaces used by database/sql are passed through to the underlying connection, when it implements them.
+type validatingConn struct {
+	driver.Conn
+	connector *validatingConnector
+}
+
+// ResetSession implements driver.SessionResetter.
+func (c *validatingConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		if err := r.ResetSession(ctx); err != nil {
+			return err
+		}
+	}
+	pinger, ok := c.Conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, connValidationTimeout)
+	defer cancel()
+	if err := pinger.Ping(ctx); err != nil {
+		slog.Debug("Discarding stale connection", "logContext", c.connector.logContext, "error", err)
+		if c.connector.stale != nil {
+			c.connector.stale.Inc()
+		}
+		// Have database/sql discard the connection and pick (or open) another one.
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator.
+func (c *validatingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// Ping implements driver.Pinger.
+func (c *validatingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// PrepareContext implements driver.ConnPrepareContext.
+func (c *validatingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Conn.Prepare(query)
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *validatingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("driver does not support non-default transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *validatingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	// Have database/sql prepare the statement instead.
+	return nil, driver.ErrSkip
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *validatingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	// Have database/sql prepare the statement instead.
+	return nil, driver.ErrSkip
+}
+
+// CheckNamedValue implements driver.NamedValueChecker.
+func (c *validatingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	// Have database/sql use its default conversions instead.
+	return driver.ErrSkip
+}
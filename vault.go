@@ -0,0 +1,170 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/burningalchemist/sql_exporter/config"
+)
+
+const (
+	// Re-read secrets without a lease (e.g. from the KV secrets engine) this often, to pick up rotated passwords.
+	vaultDefaultTTL = 5 * time.Minute
+	// Refresh Vault secrets and tokens this long before their lease expires.
+	vaultRefreshMargin = 30 * time.Second
+	// Timeout of each Vault API request.
+	vaultRequestTimeout = 10 * time.Second
+)
+
+// vaultProvider implements PasswordProvider with a password read from a HashiCorp Vault secret, authenticating with
+// either a token or an AppRole.
+type vaultProvider struct {
+	config *config.VaultConfig
+	client *http.Client
+	addr   string
+
+	mu             sync.Mutex
+	token          string
+	tokenExpiry    time.Time // zero for tokens that are not renewed (i.e. static tokens)
+	password       string
+	passwordExpiry time.Time
+}
+
+// newVaultProvider returns a PasswordProvider reading the password from the configured Vault secret.
+func newVaultProvider(vc *config.VaultConfig) (*vaultProvider, error) {
+	addr := vc.Address
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("vault address is not configured and VAULT_ADDR is not set")
+	}
+
+	p := &vaultProvider{
+		config: vc,
+		client: &http.Client{Timeout: vaultRequestTimeout},
+		addr:   strings.TrimSuffix(addr, "/"),
+	}
+	if vc.AuthMethod == "" || vc.AuthMethod == config.VaultAuthToken {
+		p.token = string(vc.Token)
+		if p.token == "" {
+			p.token = os.Getenv("VAULT_TOKEN")
+		}
+		if p.token == "" {
+			return nil, fmt.Errorf("vault token is not configured and VAULT_TOKEN is not set")
+		}
+	}
+	return p, nil
+}
+
+// Password implements PasswordProvider.
+func (p *vaultProvider) Password(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Until(p.passwordExpiry) > vaultRefreshMargin {
+		return p.password, nil
+	}
+	if err := p.login(ctx); err != nil {
+		return "", err
+	}
+
+	var secret vaultResponse
+	if err := p.request(ctx, http.MethodGet, p.config.Path, nil, &secret); err != nil {
+		return "", fmt.Errorf("unable to read Vault secret %q: %w", p.config.Path, err)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret data along with its metadata.
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+	field := p.config.Field
+	if field == "" {
+		field = config.VaultDefaultField
+	}
+	password, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %q not found in Vault secret %q", field, p.config.Path)
+	}
+
+	ttl := vaultDefaultTTL
+	if secret.LeaseDuration > 0 {
+		ttl = time.Duration(secret.LeaseDuration) * time.Second
+	}
+	slog.Debug("Read password from Vault", "path", p.config.Path, "ttl", ttl)
+	p.password, p.passwordExpiry = password, time.Now().Add(ttl)
+	return p.password, nil
+}
+
+// login fetches a new token with the AppRole auth method, if configured and the current token is about to expire.
+func (p *vaultProvider) login(ctx context.Context) error {
+	if p.config.AuthMethod != config.VaultAuthAppRole || time.Until(p.tokenExpiry) > vaultRefreshMargin {
+		return nil
+	}
+
+	mount := p.config.AppRoleMount
+	if mount == "" {
+		mount = config.VaultDefaultAppRoleMount
+	}
+	body, err := json.Marshal(map[string]string{"role_id": p.config.RoleID, "secret_id": string(p.config.SecretID)})
+	if err != nil {
+		return err
+	}
+	var resp vaultResponse
+	if err := p.request(ctx, http.MethodPost, "auth/"+mount+"/login", body, &resp); err != nil {
+		return fmt.Errorf("unable to log into Vault with AppRole: %w", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return fmt.Errorf("unable to log into Vault with AppRole: no token returned")
+	}
+
+	slog.Debug("Logged into Vault with AppRole", "lease_duration", resp.Auth.LeaseDuration)
+	p.token = resp.Auth.ClientToken
+	p.tokenExpiry = time.Now().Add(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	return nil
+}
+
+// request calls the Vault HTTP API and decodes the JSON response into out.
+func (p *vaultProvider) request(ctx context.Context, method, path string, body []byte, out *vaultResponse) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.addr+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if p.token != "" {
+		req.Header.Set("X-Vault-Token", p.token)
+	}
+	if p.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Error responses only carry error messages, never secrets.
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vaultResponse is the part of a Vault API response we care about.
+type vaultResponse struct {
+	LeaseDuration int            `json:"lease_duration"`
+	Data          map[string]any `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
@@ -0,0 +1,91 @@
+package sql_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/burningalchemist/sql_exporter/config"
+)
+
+func TestVaultProvider(t *testing.T) {
+	var logins, reads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/approle/login" {
+			var creds map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&creds); err != nil || creds["role_id"] != "role" || creds["secret_id"] != "s3cret" {
+				http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+				return
+			}
+			logins++
+			fmt.Fprint(w, `{"auth": {"client_token": "approle-token", "lease_duration": 3600}}`)
+			return
+		}
+		if token := r.Header.Get("X-Vault-Token"); token != "static-token" && token != "approle-token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		reads++
+		switch r.URL.Path {
+		case "/v1/secret/data/db":
+			fmt.Fprint(w, `{"data": {"data": {"password": "v2pass"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/db":
+			fmt.Fprint(w, `{"data": {"password": "v1pass", "pw": "v1pw"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name   string
+		config config.VaultConfig
+		want   string
+		logins int
+		reads  int
+		err    bool
+	}{
+		{"KVv1", config.VaultConfig{Path: "kv/db", Token: "static-token"}, "v1pass", 0, 1, false},
+		{"KVv1Field", config.VaultConfig{Path: "kv/db", Field: "pw", Token: "static-token"}, "v1pw", 0, 1, false},
+		{"KVv2", config.VaultConfig{Path: "secret/data/db", Token: "static-token"}, "v2pass", 0, 1, false},
+		{"AppRole", config.VaultConfig{
+			Path: "secret/data/db", AuthMethod: config.VaultAuthAppRole, RoleID: "role", SecretID: "s3cret",
+		}, "v2pass", 1, 1, false},
+		{"AppRoleInvalid", config.VaultConfig{
+			Path: "secret/data/db", AuthMethod: config.VaultAuthAppRole, RoleID: "role", SecretID: "wrong",
+		}, "", 0, 0, true},
+		{"MissingField", config.VaultConfig{Path: "kv/db", Field: "user", Token: "static-token"}, "", 0, 1, true},
+		{"BadToken", config.VaultConfig{Path: "kv/db", Token: "other-token"}, "", 0, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logins, reads = 0, 0
+			tc.config.Address = srv.URL
+			p, err := newVaultProvider(&tc.config)
+			if err != nil {
+				t.Fatalf("expected no error but got: %v", err)
+			}
+			// The second call is served from the cached password.
+			for range 2 {
+				got, err := p.Password(context.Background())
+				if tc.err {
+					if err == nil {
+						t.Fatalf("expected an error but got password %q", got)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("expected no error but got: %v", err)
+				}
+				if got != tc.want {
+					t.Fatalf("expected password %q but got: %q", tc.want, got)
+				}
+			}
+			if logins != tc.logins || reads != tc.reads {
+				t.Errorf("expected %d logins and %d reads but got %d and %d", tc.logins, tc.reads, logins, reads)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// versionQueries maps driver names to the query returning the database server version, used unless the target
+// overrides it with version_query.
+var versionQueries = map[string]string{
+	"postgres":   "SELECT version()",
+	"pgx":        "SELECT version()",
+	"mysql":      "SELECT version()",
+	"clickhouse": "SELECT version()",
+	"vertica":    "SELECT version()",
+	"sqlserver":  "SELECT @@VERSION",
+	"oracle":     "SELECT banner FROM v$version WHERE ROWNUM = 1",
+	"snowflake":  "SELECT CURRENT_VERSION()",
+	"trino":      "SELECT node_version FROM system.runtime.nodes LIMIT 1",
+	"sqlite3":    "SELECT sqlite_version()",
+}
+
+// collectVersion runs the version query, subject to the rate limits carried by ctx, and exports the version in the DB
+// version info metric. The version only changes along with the DB handle, so it's only queried until that succeeds.
+// Failures are only logged, they don't fail the scrape.
+func (t *target) collectVersion(ctx context.Context) {
+	if t.versionCollected {
+		return
+	}
+	if _, err := waitRateLimits(ctx); err != nil {
+		slog.Warn("Unable to query database version", "logContext", t.logContext, "error", err)
+		return
+	}
+	var version sql.NullString
+	if err := t.conn.QueryRowContext(ctx, t.versionQuery).Scan(&version); err != nil {
+		slog.Warn("Unable to query database version", "logContext", t.logContext, "error", err)
+		return
+	}
+	t.versionCollected = true
+	if !version.Valid {
+		slog.Debug("Database version is NULL", "logContext", t.logContext)
+		return
+	}
+	// Multi-line versions (e.g. SQL Server's) are reduced to their first line.
+	v, _, _ := strings.Cut(strings.TrimSpace(version.String), "\n")
+	dbVersionInfoMetric.DeletePartialMatch(prometheus.Labels{"job": t.jobGroup, "target": t.name})
+	dbVersionInfoMetric.WithLabelValues(t.jobGroup, t.name, strings.TrimSpace(v)).Set(1)
+}